@@ -0,0 +1,11 @@
+module pdfwrap
+
+go 1.22
+
+require (
+	github.com/go-sql-driver/mysql v1.8.1
+	github.com/lib/pq v1.10.9
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require filippo.io/edwards25519 v1.1.0 // indirect
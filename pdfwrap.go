@@ -2,20 +2,53 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	runtimedebug "runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "embed"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -27,59 +60,473 @@ var mycfg string
 var configPath = flag.String("cfg", "", "Configuration file")
 var silent = flag.Bool("s", false, "Run silently")
 var debug = flag.Bool("debug", false, "Show debugging info")
+var onlyStage = flag.String("only", "", "Run only this stage: letters, dd-format, dds or secure")
+var stagesList = flag.String("stages", "", "Comma separated stages to run, eg letters,secure (default all)")
+
+var errorPath = flag.String("errorfile", "", "Write per-record errors to this file")
+var streamName = flag.String("stream", "", "Process only the named letter or DD stream")
+var onePlan = flag.String("plan", "", "Generate and secure documents for this plan only")
+var operator = flag.String("operator", "", "Operator id recorded as the sender of emails")
+var replayRun = flag.String("replay", "", "Requeue the emails recorded in the audit table for this run id")
+var validateLtr = flag.String("validate-template", "", "Check the [[field]] tokens in this standard letter, then exit")
+var samplePlan = flag.String("sampleplan", "", "Plan number used by -validate-template, default any")
+var force = flag.Bool("force", false, "Override safety checks and re-secure files already secured")
+var explain = flag.Bool("explain", false, "Describe what a run with this configuration would do, then exit")
+var deadline = flag.Duration("deadline", 0, "Stop taking on new work after this long, eg 90m")
+var onNoWork = flag.String("onnowork", "", "Overrides Crninja.OnNoWork: proceed, exit or skip-secure")
+var verifyRun = flag.String("verifyaudit", "", "Check the signatures of the audit records for this run id, or all, then exit")
+var sandboxPlan = flag.String("sandbox", "", "Take this plan's latest letter through every stage in a temporary folder, without updating the database, then exit")
+var dryrun = flag.Bool("dryrun", false, "Log the SQL writes, commands and file changes a run would make without making them")
+var quietErrors = flag.Bool("quieterrors", false, "Only write per-record errors to the error file")
+var logPath = flag.String("logfile", "", "Write the log to this file instead of the screen")
+var reportPath = flag.String("report", "", "Write a JSON summary of the run to this file")
+var dumpConfig = flag.Bool("dumpconfig", false, "Print the configuration in effect as YAML, then exit")
+var showSecrets = flag.Bool("showsecrets", false, "Include passwords in -dumpconfig output")
+
+// Environment variables named ENV_PREFIX plus a setting's path, with
+// underscores between its parts, override the config files, eg
+// PDFWRAP_MYSQL_PASSWORD sets MySQL.Password and PDFWRAP_EMAIL_SMTP_HOST
+// sets Email.SMTP.Host. Names are case insensitive and empty ones are
+// ignored. -set overrides both.
+const ENV_PREFIX = "PDFWRAP_"
+
+// Repeatable -set Section.Field=value overrides, applied after the config files
+type overrideList []string
+
+func (o *overrideList) String() string { return strings.Join(*o, " ") }
+
+func (o *overrideList) Set(v string) error {
+	*o = append(*o, v)
+	return nil
+}
+
+var overrides overrideList
+
+func init() {
+	flag.Var(&overrides, "set", "Override a config setting, eg -set Email.TestRecipient=me@example.com (repeatable)")
+}
+
+var knownStages = []string{"letters", "dd-format", "dds", "secure"}
+
+// Stages chosen by -stages or -only, empty for all of them
+var runStages []string
 
 type MySQL struct {
-	Server   string
-	Userid   string
-	Password string
-	Database string
+	// "mysql" (default) or "postgres"
+	Driver     string
+	Server     string
+	Userid     string
+	Password   string
+	Database   string
+	PlanNoType string // "numeric" (default) or "string"
+
+	// Optional table recording what each run did, with columns RunID,
+	// LoggedAt, Action, PlanNo and Detail
+	AuditTable string
+
+	// If set, names the environment variable holding a key used to sign
+	// each audit record. Signed records also need Seq and Signature
+	// columns; every Signature is an HMAC-SHA256 covering the record and
+	// the Signature before it in the same run so that -verifyaudit can
+	// detect altered, inserted or deleted records.
+	AuditKeyEnv string
+
+	// Optional table, with columns RunID, Stream, PlanNo, PrintBatch and
+	// PrintedAt, recording when records were claimed from streams which
+	// have no PrintedWhen column of their own
+	PrintLogTable string
+
+	// Retry the initial connection this many times, waiting ConnectDelay
+	// (default 1s) before the first retry and doubling it each time
+	ConnectRetries int
+	ConnectDelay   time.Duration
+
+	// Most queries we'll run at once, regardless of the driver's own pool
+	MaxConnections int
+
+	// Longest any single query may take, default 30s
+	QueryTimeout time.Duration
+
+	// Only one run at a time may work on a database, enforced with a
+	// named lock on the server. A run finding another in progress waits
+	// up to RunLockWait (default 0, give up at once) for it to finish.
+	RunLockWait time.Duration
+
+	// Connection character set, default utf8mb4. The server converts
+	// to and from each column's own character set so text such as £
+	// survives even in latin1 tables. Passed to PostgreSQL as its
+	// client_encoding if set.
+	Charset string
+
+	// PostgreSQL only, the sslmode to connect with. The driver's own
+	// default is "require".
+	SSLMode string
 }
 
 type PDFTK struct {
+	// Which tool Exec is, pdftk (default) or qpdf. The same pdftk style
+	// operations are used throughout and translated for qpdf, which
+	// supports cat (including handles and page ranges), background,
+	// stamp, multistamp, dump_data (page count only), input_pw and
+	// owner_pw/user_pw encryption (AES-256, with allow) but not
+	// update_info, so Infofile, InfoPerFile and InfoFromPlan must be
+	// left unset. FinalArgs is passed to either as is.
+	Tool       string
 	Exec       string
 	Folder     string
 	PDFMask    string
 	Infofile   string
-	Title      string
-	Author     string
+	Title      string // Any UTF-8 text, kept to one line
+	Author     string // Likewise
 	PDFPrefix  string
 	PDFPrefix2 string
 	PDFPrefix3 string
-	OwnerPass  string
+	OwnerPass  string // Optional if documents have a user password
 	FinalArgs  string
+
+	// Retry a failed pdftk run this many times, waiting RetryDelay
+	// (default 1s) before the first retry and doubling it each time
+	MaxRetries int
+	RetryDelay time.Duration
+
+	// Passwords shorter than MinPasswordLength are replaced according to
+	// ShortPasswordAction: pad (append the plan number until long enough),
+	// random or review (default, the document isn't secured)
+	MinPasswordLength   int
+	ShortPasswordAction string
+
+	// tcustomers column random passwords are saved in, so customer services
+	// can give them out. Required for ShortPasswordAction random; a plan
+	// whose password can't be saved isn't secured.
+	RandomPasswordColumn string
+
+	// Plan field used as the user password: phone (default), postcode,
+	// customerpassword, one of Email.PlanFields or ExtraPlanColumns or any
+	// other tcustomers column. PasswordFallback names another to use when it's empty.
+	PasswordField    string
+	PasswordFallback string
+
+	// Don't require a password to open documents, just OwnerPass to
+	// change them
+	NoUserPassword bool
+
+	// What's allowed in encrypted documents: any of print, highresprint,
+	// copy, modify and annotate. Anything not listed is refused, so leaving
+	// it empty allows nothing, with either Tool.
+	Allow []string
+
+	// Check pdftk can encrypt and decrypt before processing anything
+	SelfTest bool
+
+	// Check each secured document won't open without its password but
+	// will with it before emailing it, routing it to review if not
+	VerifyPassword bool
+
+	// Write a separate info file alongside each document rather than
+	// sharing Infofile between them all
+	InfoPerFile bool
+
+	// Optional PDF stamped over every page of every secured document,
+	// eg a confidentiality notice. Relative to Folder like the blanks.
+	Stamp string
+
+	// InfoKeys, eg Creator, to remove from the generated PDFs
+	StripInfoKeys []string
+
+	// What to do if a generated PDF already exists: overwrite (default),
+	// skip or suffix (add -2, -3 etc to the new filename)
+	ExistsPolicy string
+
+	// Resolve [[field]] tokens in Title, Author and InfoExtra for each
+	// plan, as in letter bodies. Implies InfoPerFile.
+	InfoFromPlan bool
+
+	// Further Info keys to set, eg Subject, Keywords or custom ones for
+	// a document management system. Keys with empty values are skipped.
+	InfoExtra map[string]string
+
+	// PDFMask is a regex by default, set MaskMode to glob for shell style
+	// patterns like PDF-*.pdf
+	MaskMode            string
+	MaskCaseInsensitive bool
+
+	// Put documents in dated subfolders of Folder, laid out as
+	// DateFolderLayout (default 2006/01/02, ie Folder/yyyy/mm/dd)
+	DateFolders      bool
+	DateFolderLayout string
+
+	// Look for documents to secure in subfolders too
+	Recursive bool
+
+	// Refuse to secure more than this many files without -force, in case
+	// the mask is wrong. 0 means no limit.
+	MaxFiles int
+
+	// Optional per plan cover page. The template (HTML, Markdown, whatever
+	// CoverRenderer accepts) may use the same fields as the email body.
+	// CoverArgs may use #Input# and #Output#, default is "#Input# #Output#"
+	CoverTemplate string
+	CoverRenderer string
+	CoverArgs     string
+
+	// Postcode prefixes, per product (or * for all), where documents
+	// must be sent without a password
+	NoEncryptPostcodes map[string][]string
+
+	// Documents needing a human to look at them are moved here, relative
+	// to Folder unless absolute. Empty means leave them where they are.
+	ReviewFolder string
+
+	// Documents for plans whose DelMeth is routed to paper are written
+	// here, relative to Folder unless absolute, and never secured
+	PaperFolder string
+
+	// Optional object store for secured documents
+	S3 S3
+}
+
+// Secured documents are uploaded here if Bucket is set and the object's
+// s3://Bucket/key recorded as the attachment instead of the local path
+type S3 struct {
+	Endpoint     string // Default https://s3.Region.amazonaws.com
+	Region       string
+	Bucket       string
+	Prefix       string // Prepended to the object key, eg letters/
+	AccessKeyEnv string // Default AWS_ACCESS_KEY_ID
+	SecretKeyEnv string // Default AWS_SECRET_ACCESS_KEY
+	KeepLocal    bool   // Keep the local copy as well once uploaded
 }
 
 type STREAM struct {
+	Name        string // Used in messages
 	Rpt         string // Crystal Reports template
 	Table       string // tletterqq, dd_notify
 	PlanNo      string // SQL to retrieve PlanNo as string
 	Ltrid       string // StdLetter number
 	Blank       string // PDF of blank letterhead
 	PrintedWhen string // Column name of PrintedWhen if present
+
+	// Apply Blank to the first page only, like real letterhead stationery.
+	// This costs three or four pdftk runs per document instead of one.
+	BackgroundFirstPageOnly bool
+
+	// Further queue columns passed to the report as parameters of the
+	// same name alongside PrintBatch
+	Params []string
+
+	// Also combine the batch's documents into one PDF for a print bureau,
+	// with a CSV manifest of which pages belong to which plan. The
+	// optional separator (relative to Folder) goes between documents.
+	Spool          bool
+	SpoolSeparator string
+
+	// Optional second report, eg a statement of account, run with the
+	// same parameters and appended to each document
+	ExtraRpt string
+
+	// Don't generate for plans whose RecordStatus maps to skip or review
+	ApplyStatus bool
+
+	// Format the Page2 standard letter into each of Table's records
+	// still flagged edited=0 before generating, as DD notices need.
+	// Such streams belong to the dd-format and dds stages rather than
+	// letters. Page2 defaults to DDs for streams listed under Crdouble
+	// or Doubles.
+	FormatPage2 bool
+	Page2       DDS
+
+	// Optional overrides for the batch claiming SQL. These may contain the
+	// placeholders #Table#, #PrintedWhen#, #SetPrinted#, #SetClaimed#, #Today#,
+	// #DelMeth#, #DelMeths#, #Where# and #Batch#. Empty means use the built-in
+	// statements for the database.
+	Where    string   // Extra condition on which records to claim, eg Product<>'X'
+	MaxSQL   string   // Returns the highest batch number already used
+	ClaimSQL []string // Marks unclaimed records with new batch numbers
+	LastSQL  string   // Returns the batch number following the last one claimed
+	CountSQL string   // Returns the number of records waiting to be claimed
 }
 
 type CRNINJA struct {
-	Exec      string
-	DBAccess  string
+	Exec     string
+	DBAccess string
+
+	// Every stream to process, in order
+	Streams []STREAM
+
+	// The original letter and DD streams, moved to the front of Streams
+	// when the configuration is loaded
 	Crletters STREAM
 	Crdouble  STREAM
+	Letters   []STREAM // Further letter streams
+	Doubles   []STREAM // Further DD style streams
+
+	// Regexes which, if found in CRNINJA's output, mean the report didn't
+	// really work even though it exited normally
+	FailPatterns []string
+
+	// How batch numbers are allocated: session (default) relies on the
+	// claim statements alone; sequence also reserves them from
+	// SequenceTable (SeqName, NextBatch) within a single transaction
+	BatchMethod   string
+	SequenceTable string
+
+	// Optional column set to the run's ID when it claims a record and
+	// cleared once the record has been dealt with. Records still marked
+	// by a run that started more than ReclaimAfter (default 12h) ago are
+	// assumed abandoned and put back to be claimed again.
+	ClaimColumn  string
+	ReclaimAfter time.Duration
+
+	// Records generated at once, default 1 (one after the other)
+	Workers int
+
+	// How to handle each DelMeth code: email (secure and email), paper
+	// (generate into Pdftk.PaperFolder), portal-upload (secure and store
+	// but don't email) or skip (leave unclaimed). Only codes listed here
+	// are claimed; the default is email for DelMeth 1 only.
+	DeliveryMethods map[string]string
+
+	// What to do when nothing is waiting in any queue: proceed (default),
+	// exit with EXIT_NOWORK or skip-secure, ie don't scan the output folder
+	OnNoWork string
 }
 
 type TERMS map[string]string
 
 type EMAIL struct {
-	Bcc               string
-	Subject           string
+	Bcc     string
+	Subject string
+
+	// A text/template given the plan's details by name plus DearSir
+	// and PageCount, eg
+	//
+	//   Dear {{.DearSir}},
+	//   {{if .cPhone}}We'll call you on {{.cPhone}} if needed.{{end}}
+	//
+	// The older #DearSir#, #PageCount# and #PlanField# tokens still work.
+	// Also available are upper, lower and trim, eg {{upper .cPostcode}}.
 	Bodytext          string
 	Terms             TERMS
 	BadEmailDefault   string
 	BadProductDefault string
-	SendingUser       string
-	PlanFields        []string
+	SendingUser       string // Literal, #OSUser# or #DBUser#, -operator overrides
+
+	// Labels for the plan details, in the order Product, Email, Phone,
+	// Postcode, Title, Firstname, Lastname, CustomerPassword,
+	// RecordStatus, PlanNo, so #Label# in Bodytext is that detail
+	PlanFields []string
+
+	// Further tcustomers columns read for each plan, by name, alongside
+	// those pdfwrap always needs (see planDataColumns). All of them are
+	// available to Bodytext, Pdftk.CoverTemplate and Pdftk.PasswordField.
+	ExtraPlanColumns []string
+
+	TestRecipient    string   // If set, all emails go here instead of to customers
+	DateInputFormats []string // Go layouts tried in turn when reading date fields
+
+	// How date fields appear in letters, either a Go layout such as
+	// "2 Jan 2006" or tokens such as dd/mm/yyyy (see dateLayout). Default
+	// dd/mm/yyyy. Values with a time of day use DateTimeFormat if set.
+	// FieldDateFormats overrides both for particular [[fields]].
+	DateFormat       string
+	DateTimeFormat   string
+	FieldDateFormats map[string]string
+
+	// RecordStatus code => process, skip, review or template:<Terms key>
+	// Unlisted codes are processed. Documents skipped when securing are
+	// moved into the skipped subfolder.
+	StatusActions map[string]string
+
+	// Products whose documents are combined into a single email per
+	// address rather than one email per document
+	DigestProducts []string
+
+	// Send one email per address covering all its plans, whatever the
+	// product. The email, including its PlanNo and #tokens#, is based on
+	// the plan whose file comes first in name order.
+	GroupByAddress bool
+
+	// Encoding for non-ASCII text in messages we build ourselves: B
+	// (base64, default) or Q for headers, the body is quoted-printable
+	HeaderEncoding string
+
+	// Line endings for email bodies once the template has been filled in:
+	// lf or crlf. StoredLineEnding applies to MsgText in toutgoingemails
+	// (empty leaves it as written) and SMTPLineEnding to messages we send
+	// ourselves (default crlf, as SMTP requires).
+	StoredLineEnding string
+	SMTPLineEnding   string
+
+	// Clean-ups applied to letter field values, by field type (text,
+	// integer, currency or date). Any of trim, collapse, upper, lower
+	// and title, applied in the order given.
+	FieldNormalise map[string][]string
+
+	// Used for #DearSir# when a plan has neither title nor first name,
+	// otherwise the surname alone is used
+	GenericSalutation string
+
+	// Prefixed to currency field values, default £. Quote it in the YAML
+	// file, which must be saved as UTF-8.
+	CurrencySymbol string
+
+	// Remove secured PDFs once their email is queued. Only for sites
+	// whose sender doesn't need the file afterwards.
+	DeleteAfterEmail bool
+
+	// Replaces the built-in customer details query, eg to join other
+	// tables. Must return, for the plan #PlanNo#, columns named as in
+	// planDataColumns plus any ExtraPlanColumns. Queries returning just the ten
+	// columns Product, Email, Phone, Postcode, Title, Firstname, Lastname,
+	// CustomerPassword, RecordStatus, PlanNo are still read in that order.
+	PlanDataSQL string
+
+	// RecordStatus codes whose documents are produced but not emailed
+	NoEmailStatuses []string
+
+	// What to do, by product or * for all, when a plan has no email
+	// address: use-default (BadEmailDefault), skip-email or route-to-review
+	NoEmailAction map[string]string
+
+	// Fill in #PageCount# in Bodytext with the pages of the original,
+	// unsecured documents. Costs an extra pdftk run per document, and is
+	// left blank when replaying emails as the originals are gone.
+	IncludePageCount bool
+
+	// Server used for messages we send ourselves
+	SMTP SMTP
+
+	// How customer emails go out: queue (default) leaves them in
+	// toutgoingemails for a separate sender, smtp sends them via SMTP.
+	// When sending ourselves each email is still recorded there and
+	// SentColumn (if set) names a toutgoingemails column set to when the
+	// email was sent, left NULL if sending failed.
+	Delivery   string
+	SentColumn string
+
+	// If set, a summary of each run is emailed here
+	NotifyAddress string
+
+	// Set if tcustomers has no CustomerPassword column
+	NoCustomerPassword bool
+}
+
+type SMTP struct {
+	Host     string
+	Port     int // Default 25
+	Username string
+	Password string
+	From     string
+	StartTLS bool
 }
 
+// The page 2 letter of DD notices, also the default Page2 of streams
+// listed under Crdouble or Doubles
 type DDS struct {
-	Page2Ltr string
+	Page2Ltr     string
+	BodyColumn   string // dd_notify column for the letter body, default ltr2Body
+	HeaderColumn string // Optional column for the letter header
+	FooterColumn string // Optional column for the letter footer
 }
 
 var CFG struct {
@@ -93,529 +540,5036 @@ var CFG struct {
 // Flag used on database to indicate letter sent via email rather than paper
 const DELMETH_EMAIL = "1"
 
-var DBH *sql.DB
+// Shown by -dumpconfig in place of passwords
+const REDACTED = "********"
 
-func main() {
+// Values for Crninja.DeliveryMethods
+const DELIVER_EMAIL = "email"
+const DELIVER_PAPER = "paper"
+const DELIVER_PORTAL = "portal-upload"
+const DELIVER_SKIP = "skip"
 
-	var err error
+// Marks generated documents which are to be stored rather than emailed
+const PORTAL_SUFFIX = "-portal"
 
-	flag.Parse()
+// The customer details every plan needs, by column name, see getPlanData
+const PD_PRODUCT = "Product"
+const PD_EMAIL = "cEmail"
+const PD_PHONE = "cPhone"
+const PD_POSTCODE = "cPostcode"
+const PD_TITLE = "cTitle"
+const PD_FIRSTNAME = "cFirstname"
+const PD_LASTNAME = "cLastname"
+const PD_PASSWORD = "CustomerPassword"
+const PD_STATUS = "RecordStatus"
+const PD_PLANNO = "PlanNo"
 
-	if !*silent {
-		fmt.Println(ProgramVersion)
-	}
-	loadConfig()
+var planDataColumns = []string{PD_PRODUCT, PD_EMAIL, PD_PHONE, PD_POSTCODE, PD_TITLE, PD_FIRSTNAME, PD_LASTNAME, PD_PASSWORD, PD_STATUS, PD_PLANNO}
 
-	if *debug {
-		fmt.Println("Opening database " + CFG.MySQL.Server)
-	}
-	connectStr := CFG.MySQL.Userid + ":" + CFG.MySQL.Password + "@tcp(" + CFG.MySQL.Server + ")/" + CFG.MySQL.Database
-	//connectStr += "?allowCleartextPasswords=true"
-	DBH, err = sql.Open("mysql", connectStr)
-	checkerr(err)
-	defer DBH.Close()
-	if !checkDatabase() {
-		os.Exit(1)
-	}
-	if *debug {
-		fmt.Println("Database opened")
-	}
+// Separates multiple files in toutgoingemails.Attachments
+const ATTACHMENT_SEPARATOR = ";"
 
-	processLetterQ()
-	processDDQ()
-	makeSecurePDFs()
-	if !*silent {
-		fmt.Println("Run complete")
-	}
-}
+// Actions available in Email.StatusActions
+const STATUS_PROCESS = "process"
+const STATUS_SKIP = "skip"
+const STATUS_REVIEW = "review"
+const STATUS_TEMPLATE = "template"
 
-// Alphabetic below
+// Subfolder of the output folder where documents for plans whose status
+// is skip are moved, so they aren't picked up again by every run
+const SKIPPED_FOLDER = "skipped"
 
-func checkDatabase() bool {
+// Values for Crninja.BatchMethod
+const BATCH_SESSION = "session"
+const BATCH_SEQUENCE = "sequence"
+const DEFAULT_SEQUENCETABLE = "tbatchsequence"
 
-	rows, err := DBH.Query("SELECT Count(*) FROM tliterals")
-	checkerr(err)
-	defer rows.Close()
-	var res int64
-	if rows.Next() {
-		rows.Scan(&res)
-		if *debug {
-			fmt.Printf("Count(tliterals)=%v\n", res)
-		}
-	}
-	return true
-}
+// Default for Crninja.ReclaimAfter
+const DEFAULT_RECLAIMAFTER = 12 * time.Hour
 
-func checkerr(err error) {
+// Leading part of every run ID
+const RUNID_LAYOUT = "20060102150405"
 
-	if err != nil {
-		panic(err.Error())
-	}
+// Values for Pdftk.PasswordField with the plan data column they use
+var passwordFields = map[string]string{"phone": PD_PHONE, "postcode": PD_POSTCODE, "customerpassword": PD_PASSWORD}
 
+const DEFAULT_PASSWORDFIELD = "phone"
+
+// Values for Pdftk.Tool
+const TOOL_PDFTK = "pdftk"
+const TOOL_QPDF = "qpdf"
+
+// qpdf's exit status when it succeeded but had something to say
+const QPDF_WARNINGS = 3
+
+// Values for Pdftk.Allow and the pdftk permissions they grant
+var allowKeywords = map[string]string{
+	"print":        "DegradedPrinting",
+	"highresprint": "Printing",
+	"copy":         "CopyContents",
+	"modify":       "ModifyContents",
+	"annotate":     "ModifyAnnotations",
 }
 
-func emailSecurePDF(pdf string, plandata []string) {
-	//    0       1      2       3        4        5         6             7             8          9
-	// Product,cEmail,cPhone,cPostcode,cTitle,cFirstname,cLastname,CustomerPassword,RecordStatus,PlanNo
+// Values for Pdftk.ShortPasswordAction
+const SHORTPW_PAD = "pad"
+const SHORTPW_RANDOM = "random"
+const SHORTPW_REVIEW = "review"
 
-	DearSir := plandata[4]
-	if DearSir == "" {
-		DearSir = plandata[5][:1] // First initial
-	}
-	DearSir += " " + plandata[6]
-	BodyText := CFG.Email.Bodytext
-	BodyText = strings.ReplaceAll(BodyText, "#DearSir#", DearSir)
-	for pi, pf := range CFG.Email.PlanFields {
-		BodyText = strings.ReplaceAll(BodyText, "#"+pf+"#", plandata[pi])
-	}
+// Values for Pdftk.ExistsPolicy
+const EXISTS_OVERWRITE = "overwrite"
+const EXISTS_SKIP = "skip"
+const EXISTS_SUFFIX = "suffix"
 
-	xsql := "INSERT INTO toutgoingemails (SentAt,SentBy,PlanNo,ToAddress"
-	if CFG.Email.Bcc == "" {
-		xsql += ",BCAddress"
-	}
-	xsql += ",Subject,MsgText,Attachments) VALUES("
-	xsql += "Now(),'" + safesql(CFG.Email.SendingUser) + "'," + safesql(plandata[9])
-	if plandata[1] == "" {
-		plandata[1] = safesql(CFG.Email.BadEmailDefault)
-	}
-	xsql += ",'" + safesql(plandata[1]) + "'"
-	if CFG.Email.Bcc == "" {
-		xsql += ",'" + safesql(CFG.Email.Bcc) + "'"
-	}
-	xsql += ",'" + safesql(CFG.Email.Subject) + "'"
-	xsql += ",'" + safesql(BodyText) + "'"
-	xsql += ",'" + safesql(pdf) + "'"
-	xsql += ")"
-	runsql(xsql)
+// Standard letter text, pass the LtrID as the argument
+const FETCHTEXT = `FROM tStdLetters 
+						LEFT JOIN tStdLetterHeaders ON tStdLetters.LtrHeaderID=tStdLetterHeaders.HdrID 
+						LEFT JOIN tStdLetterFooters ON tStdLetters.LtrFooterID=tStdLetterFooters.FtrID 
+						WHERE LtrID=?`
 
-}
+// Values for Email.Delivery
+const DELIVERY_QUEUE = "queue"
+const DELIVERY_SMTP = "smtp"
 
-func formatDate(iso8601 string) string {
+// Values for Email.NoEmailAction
+const NOEMAIL_DEFAULT = "use-default"
+const NOEMAIL_SKIP = "skip-email"
+const NOEMAIL_REVIEW = "route-to-review"
 
-	return iso8601[8:10] + "/" + iso8601[5:7] + "/" + iso8601[0:4]
-}
+// Field types held in tStdLetterFields
+const FIELD_VALUE_TYPE_TEXT = 0
+const FIELD_VALUE_TYPE_INTEGER = 1
+const FIELD_VALUE_TYPE_CURRENCY = 2
+const FIELD_VALUE_TYPE_DATE = 3
 
-func formatDDPage2s() {
+// Shown for a date field that's NULL
+const DEFAULT_NULL_DATE = "2004-01-01"
 
-	// This formats the relevant standard letter into each of the DD_NOTIFY records
-	// ready for DD notice printing
+// #DearSir# when there's no name at all to go on
+const DEFAULT_SALUTATION = "Customer"
 
-	const FETCHTEXT = `FROM tStdLetters 
-						LEFT JOIN (tStdLetterHeaders, tStdLetterFooters) 
-						ON tStdLetters.LtrHeaderID=tStdLetterHeaders.HdrID 
-						AND tStdLetters.LtrFooterID=tStdLetterFooters.FtrID 
-						WHERE LtrID=`
-	bodyText := getStringFromDB("SELECT LtrBody "+FETCHTEXT+CFG.DDs.Page2Ltr, "")
-	//	headText := getStringFromDB("SELECT HdrHeader "+FETCHTEXT+CFG.DDs.Page2Ltr, "")
-	//	footText := getStringFromDB("SELECT FtrFooter "+FETCHTEXT+CFG.DDs.Page2Ltr, "")
-	var page2s = make(map[int]string)
+// Written as an escape so the source file's encoding can't mangle it
+const DEFAULT_CURRENCY_SYMBOL = "\u00a3" // £
 
-	xsql := "SELECT dd_notify.ID, dd_notify.AccountRef FROM dd_notify WHERE edited=0"
-	rows, err := DBH.Query((xsql))
-	checkerr(err)
-	defer rows.Close()
-	for rows.Next() {
-		var id int
-		var account string
-		rows.Scan(&id, &account)
-		page2s[id] = account
-	}
-	rows.Close()
-	for id, plan := range page2s {
-		xsql := "UPDATE dd_notify SET ltr2Body='" + safesql(replaceFields(bodyText, plan)) + "' WHERE id=" + strconv.Itoa(id)
-		runsql(xsql)
-	}
+// Names for tstdletterfields.FieldValueType as used in Email.FieldNormalise
+var fieldTypeNames = map[int64]string{0: "text", 1: "integer", 2: "currency", 3: "date"}
+
+// Default for Email.DateFormat
+const DEFAULT_DATE_FORMAT = "dd/mm/yyyy"
 
+// Date values may arrive as plain dates, MySQL datetimes or, if the driver
+// has parseTime enabled, Go's rendering of a time.Time
+var DEFAULT_DATE_LAYOUTS = []string{
+	"2006-01-02",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700 MST",
 }
 
-func generatePDFs(whichq STREAM) {
+// Values for MySQL.Driver
+const DRIVER_MYSQL = "mysql"
+const DRIVER_POSTGRES = "postgres"
 
-	// Need to process letter queue one record at a time so ...
-	// First, mark the whole batch as belonging to me
+// Default batch claiming statements, MySQL specific
+const DEFAULT_MAXSQL = "SELECT MAX(PrintBatch) AS MaxBatch FROM #Table#"
+const DEFAULT_LASTSQL = "SELECT (@B := @B + 1)"
 
-	xsql := "SELECT MAX(PrintBatch) AS MaxBatch FROM " + whichq.Table
-	Batch2Print := getIntegerFromDB(xsql, 0)
+// PostgreSQL has no session variables so number the claimed rows within
+// the one statement instead. Like MySQL's @B, LastSQL gives the batch
+// number after the last one claimed.
+const POSTGRES_LASTSQL = "SELECT COALESCE(MAX(PrintBatch),0)+1 FROM #Table#"
 
-	xsql = "SET @B := " + strconv.FormatInt(Batch2Print, 10) + ";"
-	runsql(xsql)
-	xsql = "UPDATE " + whichq.Table + " SET PrintBatch=(SELECT @B := @B + 1)"
-	if whichq.PrintedWhen != "" {
-		xsql += "," + whichq.PrintedWhen + "=" + sqldate(time.Now())
-	}
-	xsql += " WHERE PrintBatch=0 AND DelMeth=" + DELMETH_EMAIL
-	runsql(xsql)
-	LastBatch := getIntegerFromDB("SELECT (@B := @B + 1)", 0)
+var POSTGRES_CLAIMSQL = []string{
+	"UPDATE #Table# SET PrintBatch=#Batch#+n.rn#SetPrinted##SetClaimed# FROM (SELECT ctid, row_number() OVER () AS rn FROM #Table# WHERE PrintBatch=0 AND DelMeth IN (#DelMeths#)#Where#) n WHERE #Table#.ctid=n.ctid",
+}
 
-	// Now loop through that marked batch
-	xsql = "SELECT " + whichq.PlanNo + "," + whichq.Ltrid + " FROM " + whichq.Table
-	xsql += " WHERE PrintBatch > " + strconv.FormatInt(Batch2Print, 10) + " AND PrintBatch <= " + strconv.FormatInt(LastBatch, 10)
-	if *debug {
-		fmt.Println(xsql)
-	}
-	rows, err := DBH.Query(xsql)
-	checkerr(err)
-	defer rows.Close()
-	ndox := 0
-	for rows.Next() {
-		var PlanNo string
-		var Ltrid string
-		rows.Scan(&PlanNo, &Ltrid)
-		Batch2Print++
-		ndox++
-		fname := filepath.Join(CFG.Pdftk.Folder, CFG.Pdftk.PDFPrefix+PlanNo+"-"+Ltrid+"-draft.pdf")
-		fname2 := strings.Replace(fname, "-draft.pdf", ".pdf", 1)
+const DEFAULT_COUNTSQL = "SELECT COUNT(*) FROM #Table# WHERE PrintBatch=0 AND DelMeth IN (#DelMeths#)#Where#"
 
-		// Now run CrystalReportsNinja to generate the PDF
-		args := []string{"-F", CFG.Crninja.Crletters.Rpt, "-O", fname}
-		args = append(args, "-E", "pdf")
-		args = append(args, "-a", "PrintBatch:"+strconv.FormatInt(Batch2Print, 10))
-		args = append(args, strings.Split(CFG.Crninja.DBAccess, " ")...)
+var DEFAULT_CLAIMSQL = []string{
+	"SET @B := #Batch#;",
+	"UPDATE #Table# SET PrintBatch=(SELECT @B := @B + 1)#SetPrinted##SetClaimed# WHERE PrintBatch=0 AND DelMeth IN (#DelMeths#)#Where#",
+}
 
-		if *debug {
-			fmt.Printf(`CRNINJA: "%v" %v`+"\n", CFG.Crninja.Exec, strings.Join(args, " "))
-		}
-		cmd := exec.Command(CFG.Crninja.Exec, args...)
-		err := cmd.Run()
-		checkerr(err)
+// dialect holds what differs between the supported databases
+type dialect struct {
+	ClaimSQL       []string
+	LastSQL        string
+	CurrentUserSQL string
+	LockSQL        string // Takes the lock named #Lock#, returning 1
+	UnlockSQL      string // Releases it after commit, if it outlives the transaction
+	TryLockSQL     string // Takes the session lock #Lock# if free, returning 1
+	DSN            func() string
+	Numbered       bool // Placeholders are $1, $2 ... rather than ?
+	DoubleQuotes   bool // Quotes in strings are doubled rather than escaped
+}
 
-		args = []string{fname}
-		if whichq.Blank != "" {
-			args = append(args, "background", filepath.Join(CFG.Pdftk.Folder, whichq.Blank))
-		}
-		args = append(args, "output", fname2)
-		runPdftk(args)
-		os.Remove(fname)
+var dialects = map[string]dialect{
+	DRIVER_MYSQL: {
+		ClaimSQL:       DEFAULT_CLAIMSQL,
+		LastSQL:        DEFAULT_LASTSQL,
+		CurrentUserSQL: "SELECT CURRENT_USER()",
+		LockSQL:        "SELECT GET_LOCK('#Lock#', -1)",
+		UnlockSQL:      "SELECT RELEASE_LOCK('#Lock#')",
+		TryLockSQL:     "SELECT GET_LOCK('#Lock#', 0)",
+		DSN:            mysqlDSN,
+	},
+	DRIVER_POSTGRES: {
+		ClaimSQL:       POSTGRES_CLAIMSQL,
+		LastSQL:        POSTGRES_LASTSQL,
+		CurrentUserSQL: "SELECT CURRENT_USER",
+		LockSQL:        "SELECT 1 FROM pg_advisory_xact_lock(hashtext('#Lock#'))",
+		TryLockSQL:     "SELECT CASE WHEN pg_try_advisory_lock(hashtext('#Lock#')) THEN 1 ELSE 0 END",
+		DSN:            postgresDSN,
+		Numbered:       true,
+		DoubleQuotes:   true,
+	},
+}
 
-	}
-	if !*silent {
-		fmt.Printf("%v PDFs generated\n", ndox)
-	}
+var DBH *sql.DB
+
+// Rows is what's read from a query's results, as *sql.Rows
+type Rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Columns() ([]string, error)
+	Err() error
+	Close() error
+}
+
+// Querier runs SQL: the database, one of its connections or a transaction
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Database is what the queries and updates need from DBH
+type Database interface {
+	Querier
+	// Conn reserves a single session, for locks and transactions
+	Conn(ctx context.Context) (DBConn, error)
+}
+
+// DBConn is one session with the database
+type DBConn interface {
+	Querier
+	BeginTx(ctx context.Context) (DBTx, error)
+	Close() error
+}
 
+// DBTx is a transaction on a DBConn
+type DBTx interface {
+	Querier
+	Commit() error
+	Rollback() error
 }
 
-func getFloatFromDB(xsql string, xdef float64) float64 {
+// DB is DBH once connected. Tests can set it to a stub returning canned
+// rows instead.
+var DB Database
+
+// sqlDB, sqlConn and sqlTx adapt database/sql to Database
+type sqlDB struct{ db *sql.DB }
+type sqlConn struct{ conn *sql.Conn }
+type sqlTx struct{ tx *sql.Tx }
 
-	rows, err := DBH.Query(xsql)
+func (d sqlDB) QueryContext(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return xdef
-	}
-	defer rows.Close()
-	var res float64
-	if rows.Next() {
-		rows.Scan(&res)
-		return res
-	} else {
-		return xdef
+		return nil, err
 	}
+	return rows, nil
+}
 
+func (d sqlDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return d.db.ExecContext(ctx, query, args...)
 }
-func getIntegerFromDB(xsql string, xdef int64) int64 {
 
-	if *debug {
-		fmt.Println(xsql)
-	}
-	rows, err := DBH.Query(xsql)
+func (d sqlDB) Conn(ctx context.Context) (DBConn, error) {
+	conn, err := d.db.Conn(ctx)
 	if err != nil {
-		if *debug {
-			fmt.Printf("getIntegerFromDB FAILED - %v\n", err.Error())
-		}
-		return xdef
+		return nil, err
 	}
-	defer rows.Close()
-	var res int64
-	if rows.Next() {
-		rows.Scan(&res)
-		if *debug {
-			fmt.Printf("Returning %v\n", res)
-		}
-		return res
-	} else {
-		return xdef
+	return sqlConn{conn}, nil
+}
+
+func (c sqlConn) QueryContext(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := c.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
+	return rows, nil
 }
 
-func getStringFromDB(xsql string, xdef string) string {
+func (c sqlConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.conn.ExecContext(ctx, query, args...)
+}
 
-	if *debug {
-		fmt.Println(xsql)
-	}
-	rows, err := DBH.Query(xsql)
+func (c sqlConn) BeginTx(ctx context.Context) (DBTx, error) {
+	tx, err := c.conn.BeginTx(ctx, nil)
 	if err != nil {
-		if *debug {
-			fmt.Printf("getStringFromDB FAILED - %v\n", err.Error())
-			os.Exit(1)
-		}
-
-		return xdef
+		return nil, err
 	}
-	defer rows.Close()
-	var res string
-	if rows.Next() {
-		rows.Scan(&res)
-		if *debug {
-			fmt.Printf("Returning '%v'\n", res)
-		}
-		return res
-	} else {
-		return xdef
+	return sqlTx{tx}, nil
+}
+
+func (c sqlConn) Close() error {
+	return c.conn.Close()
+}
+
+func (t sqlTx) QueryContext(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := t.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
+	return rows, nil
+}
 
+func (t sqlTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return t.tx.ExecContext(ctx, query, args...)
 }
 
-func loadConfig() {
+func (t sqlTx) Commit() error {
+	return t.tx.Commit()
+}
 
-	d := yaml.NewDecoder(strings.NewReader(mycfg))
+func (t sqlTx) Rollback() error {
+	return t.tx.Rollback()
+}
 
-	cfgp := &CFG
+// Initial wait before retrying the database connection
+const DEFAULT_CONNECTDELAY = time.Second
 
-	if err := d.Decode(&cfgp); err != nil {
-		fmt.Printf("Embedded parse failed %v\n", err)
-		return
-	}
+// Default cap on simultaneous database access by this program
+const DEFAULT_MAXCONNECTIONS = 4
 
-	if *configPath == "" {
-		return
-	}
-	if _, err := os.Stat(*configPath); os.IsNotExist(err) {
-		return
-	}
+// Set by -sandbox: documents go to a temporary folder and nothing is
+// written to the database
+var sandboxed bool
+var sandboxFolder string
 
-	file, err := os.Open(*configPath)
-	if err != nil {
-		return
-	}
-	defer file.Close()
+// Where secured documents are finally kept
+type docStore interface {
+	// Put stores a local document, returning the reference to record
+	Put(local string) (string, error)
+}
 
-	if !*silent {
-		fmt.Printf("Parsing %v\n", *configPath)
-	}
+// localStore leaves documents where pdftk wrote them
+type localStore struct{}
 
-	// Start YAML decoding from file
-	d = yaml.NewDecoder(file)
+func (localStore) Put(local string) (string, error) {
+	return local, nil
+}
 
-	if err := d.Decode(&cfgp); err != nil {
-		fmt.Printf("Parse failed %v\n", err)
-		return
-	}
+// s3Store uploads documents to an S3 compatible bucket
+type s3Store struct {
+	cfg       S3
+	accessKey string
+	secretKey string
 }
 
-func makeInfoFile() {
+var store docStore = localStore{}
 
-	/*
-	 * This creates a text file in the format required by PDFTK used to hold
-	 * metadata for the generated PDFs.
-	 *
-	 */
+// Local path => store reference of documents uploaded this run
+var storedAs = make(map[string]string)
 
-	const datefmt = "20060102150405000" // Equivalent to VB.Net string "yyyyMMddhhmmsszzz"
+// A record claimed from a stream, waiting to be generated
+type queued struct {
+	PlanNo     string
+	Ltrid      string
+	PrintBatch int64
+	Params     []string // Name:value for crninja
+	DelMeth    string
+}
 
-	f, err := os.Create(filepath.Join(CFG.Pdftk.Folder, CFG.Pdftk.Infofile))
-	checkerr(err)
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	w.WriteString("InfoBegin\n")
-	w.WriteString("InfoKey: Title\n")
-	w.WriteString("InfoValue: " + CFG.Pdftk.Title + "\n")
-	w.WriteString("InfoBegin\n")
-	w.WriteString("InfoKey: Author\n")
-	w.WriteString("InfoValue: " + CFG.Pdftk.Author + "\n")
-	w.WriteString("InfoBegin\n")
-	w.WriteString("InfoKey: Producer\n")
-	w.WriteString("InfoValue: " + ProgramVersion + "\n")
-	w.WriteString("InfoBegin\n")
-	w.WriteString("InfoKey: CreationDate\n")
-	t := time.Now()
-	w.WriteString("InfoValue: D'" + t.Format(datefmt) + "'\n")
-	w.Flush()
+// Semaphore limiting our own use of the database, see dbAcquire
+var dbsem chan struct{}
 
-}
+// Identifies this run in the audit table
+var runID string
+var runStart time.Time
 
-func makeSecurePDFs() {
+// Signing key and chain state for audit records, see MySQL.AuditKeyEnv
+var auditKey []byte
+var auditSeq int
+var auditPrev string
 
-	const DATA_SEPARATOR = ";;"
+// auditTime is an audit record's LoggedAt, which drivers return as a
+// time.Time or, like MySQL without parseTime, as text. Records are signed
+// with it formatted as time.DateTime.
+type auditTime struct{ time.Time }
 
-	//    0       1      2       3        4        5         6             7             8          9
-	// Product,cEmail,cPhone,cPostcode,cTitle,cFirstname,cLastname,CustomerPassword,RecordStatus,PlanNo
-	var pdsql = `SELECT Concat_WS('` + DATA_SEPARATOR + `',IfNull(Product,'` + CFG.Email.BadProductDefault + `'),
-					IfNull(cEmail,'` + CFG.Email.BadEmailDefault + `'),
-					IfNull(cPhone,''),IfNull(cPostcode,''),
-					IfNull(cTitle,''),
-					IfNull(cFirstname,''),
-					IfNull(cLastname,''),
-					IfNull(CustomerPassword,''),
-					RecordStatus,PlanNo) AS PlanData FROM tcustomers WHERE PlanNo=`
+// Cancelled on SIGINT, aborting any queries in progress
+var dbCtx context.Context
 
-	if !*silent {
-		fmt.Println("Making secure PDFs ... ")
-	}
+// Exit codes for a run that couldn't finish. EXIT_CONFIG also covers
+// bad command line flags and configured SQL that won't run.
+const EXIT_CONFIG = 1
+const EXIT_DATABASE = 2
+const EXIT_GENERATION = 3
+const EXIT_EMAIL = 4
 
-	makeInfoFile()
+// Exit code used when the operator interrupted the run
+const EXIT_INTERRUPTED = 7
 
-	x := filepath.Join(CFG.Pdftk.Folder, CFG.Pdftk.PDFPrefix+"*.pdf")
-	if *debug {
-		fmt.Printf("Scanning %v\n", x)
-	}
-	files, _ := os.ReadDir(CFG.Pdftk.Folder)
-	myfile, _ := regexp.Compile(CFG.Pdftk.PDFMask)
-	rplan, _ := regexp.Compile(`-(\d+)-`)
-	nrex := 0
-	for _, file := range files {
-		Filename := file.Name()
-		if !myfile.MatchString(Filename) {
+// Initial wait before retrying pdftk
+const DEFAULT_RETRYDELAY = time.Second
+
+// Default for MySQL.QueryTimeout
+const DEFAULT_QUERYTIMEOUT = 30 * time.Second
+
+// Cancelled when the -deadline expires
+var runCtx context.Context
+var cancelRun context.CancelFunc
+
+// Exit code used when the run was cut short by -deadline
+const EXIT_DEADLINE = 5
+
+// Exit code used when Crninja.OnNoWork is exit and the queues are empty
+const EXIT_NOWORK = 6
+
+// Exit code used when another run still held the run lock after
+// MySQL.RunLockWait
+const EXIT_LOCKED = 8
+
+// Exit code used when more files matched than Pdftk.MaxFiles and the
+// operator didn't confirm securing them
+const EXIT_MAXFILES = 9
+
+// Returned by makeSecurePDFs when it declines to secure more than
+// Pdftk.MaxFiles files
+var errTooManyFiles = errors.New("more files than Pdftk.MaxFiles")
+
+// How often a run waiting for the run lock tries again
+const RUNLOCK_POLL = 5 * time.Second
+
+// Values for Crninja.OnNoWork
+const NOWORK_PROCEED = "proceed"
+const NOWORK_EXIT = "exit"
+const NOWORK_SKIPSECURE = "skip-secure"
+
+// Letter field values fetched in bulk, FieldID => PlanNo => value
+var fieldCache = make(map[string]map[string]string)
+
+// Runner runs an external program, returning its combined output
+type Runner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// execRunner is the Runner that actually runs things
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// A letter field as defined in tstdletterfields
+type fieldDef struct {
+	SQL  string
+	Type int64
+}
+
+// Every field definition, by lower case FieldID, read once by letterField.
+// fieldDefsErr is why they couldn't be read.
+var fieldDefs map[string]fieldDef
+var fieldDefsErr error
+var fieldDefsOnce sync.Once
+
+// Per-record errors are logged here if -errorfile is used
+var errorFile *os.File
+var errorMu sync.Mutex // Generation workers may report at once
+var nerrors int
+var errorMsgs []string
+
+// Runs pdftk, CRNINJA and the cover renderer. Tests can swap in a fake
+// to check the arguments built without needing the real programs.
+var runner Runner = execRunner{}
+
+// Totals for the run summary, written as JSON by -report
+type runStats struct {
+	RunID         string         `json:"run_id"`
+	Start         time.Time      `json:"start"`
+	End           time.Time      `json:"end"`
+	ExitCode      int            `json:"exit_code"`
+	DryRun        bool           `json:"dry_run"`
+	Generated     int            `json:"generated"`
+	Secured       int            `json:"secured"`
+	Emailed       int            `json:"emails_queued"`
+	Reports       int            `json:"reports"` // CRNINJA runs which worked
+	ReportsFailed int            `json:"reports_failed"`
+	Failures      map[string]int `json:"failures"` // Records skipped by stage
+	Batches       []claimedRange `json:"batches"`
+}
+
+// The PrintBatch numbers a stream claimed
+type claimedRange struct {
+	Stream string `json:"stream"`
+	First  int64  `json:"first"`
+	Last   int64  `json:"last"`
+}
+
+var stats = runStats{Failures: map[string]int{}}
+var statsMu sync.Mutex // Guards stats.Reports* from generation workers
+
+// Email.Bodytext and Pdftk.CoverTemplate, parsed at startup
+var bodyTemplate *template.Template
+var coverTemplate *template.Template
+
+// Most lines of CRNINJA's output quoted when it fails
+const CRNINJA_OUTPUT_LINES = 3
+
+// Crninja.FailPatterns, compiled at startup
+var failPatterns []*regexp.Regexp
+
+// The page count in pdftk's dump_data and qpdf's --show-npages output
+var pdftkPages = regexp.MustCompile(`NumberOfPages:\s*(\d+)`)
+var qpdfPages = regexp.MustCompile(`(?m)^\s*(\d+)\s*$`)
+
+func main() {
+
+	var err error
+
+	flag.Parse()
+	if *dumpConfig {
+		*silent = true // Nothing but the YAML on stdout
+	}
+	runStart = time.Now()
+	runID = runStart.Format(RUNID_LAYOUT) + "-" + strconv.Itoa(os.Getpid())
+	stats.RunID = runID
+	stats.Start = runStart
+	stats.DryRun = *dryrun
+	if err := setupLogging(); err != nil {
+		slog.Error("Cannot open log file", "err", err)
+		os.Exit(EXIT_CONFIG)
+	}
+
+	slog.Info("Starting", "version", ProgramVersion)
+	if *onlyStage != "" && *stagesList != "" {
+		slog.Error("Use either -only or -stages, not both")
+		os.Exit(EXIT_CONFIG)
+	}
+	for _, stage := range strings.Split(*onlyStage+*stagesList, ",") {
+		stage = strings.TrimSpace(stage)
+		if stage == "" {
+			continue
+		}
+		if !slices.Contains(knownStages, stage) {
+			slog.Error("Unknown stage", "stage", stage, "known", strings.Join(knownStages, ", "))
+			os.Exit(EXIT_CONFIG)
+		}
+		runStages = append(runStages, stage)
+	}
+	if err := loadConfig(); err != nil {
+		fail(EXIT_CONFIG, "Cannot load configuration", err)
+	}
+	if err := applyEnvironment(); err != nil {
+		slog.Error("Bad environment setting", "err", err)
+		os.Exit(EXIT_CONFIG)
+	}
+	for _, o := range overrides {
+		if err := applyOverride(o); err != nil {
+			slog.Error("Bad -set", "set", o, "err", err)
+			os.Exit(EXIT_CONFIG)
+		}
+	}
+	normaliseStreams()
+
+	if *streamName != "" && !streamConfigured(*streamName) {
+		slog.Error("No such stream configured", "stream", *streamName)
+		os.Exit(EXIT_CONFIG)
+	}
+	if *onePlan != "" {
+		// Goes into SQL unquoted when plan numbers are numeric
+		valid := `^\d+$`
+		if planNoIsString() {
+			valid = `^\w+$`
+		}
+		if !regexp.MustCompile(valid).MatchString(*onePlan) {
+			slog.Error("Bad -plan", "PlanNo", *onePlan)
+			os.Exit(EXIT_CONFIG)
+		}
+	}
+
+	var stopSignals context.CancelFunc
+	dbCtx, stopSignals = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stopSignals()
+	if *deadline > 0 {
+		runCtx, cancelRun = context.WithTimeout(dbCtx, *deadline)
+	} else {
+		runCtx, cancelRun = context.WithCancel(dbCtx)
+	}
+	defer cancelRun()
+
+	if *errorPath != "" {
+		errorFile, err = os.OpenFile(*errorPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fail(EXIT_CONFIG, "Cannot open error file "+*errorPath, err)
+		}
+		defer errorFile.Close()
+	}
+
+	if *onNoWork != "" {
+		CFG.Crninja.OnNoWork = *onNoWork
+	}
+	if CFG.Crninja.OnNoWork == "" {
+		CFG.Crninja.OnNoWork = NOWORK_PROCEED
+	}
+	if CFG.MySQL.Driver == "" {
+		CFG.MySQL.Driver = DRIVER_MYSQL
+	}
+	if CFG.Email.Delivery == "" {
+		CFG.Email.Delivery = DELIVERY_QUEUE
+	}
+	if CFG.Pdftk.Tool == "" {
+		CFG.Pdftk.Tool = TOOL_PDFTK
+	}
+	if CFG.Pdftk.PasswordField == "" {
+		CFG.Pdftk.PasswordField = DEFAULT_PASSWORDFIELD
+	}
+
+	if *dumpConfig {
+		if err := dumpConfiguration(); err != nil {
+			slog.Error("Cannot dump configuration", "err", err)
+			os.Exit(EXIT_CONFIG)
+		}
+		return
+	}
+
+	if *explain {
+		explainConfig()
+		return
+	}
+
+	if problems := validateConfig(); len(problems) > 0 {
+		for _, p := range problems {
+			slog.Error("Configuration problem", "problem", p)
+		}
+		os.Exit(EXIT_CONFIG)
+	}
+	for _, pattern := range CFG.Crninja.FailPatterns {
+		failPatterns = append(failPatterns, regexp.MustCompile(pattern)) // Already checked
+	}
+
+	if CFG.MySQL.AuditKeyEnv != "" {
+		auditKey = []byte(os.Getenv(CFG.MySQL.AuditKeyEnv))
+		if len(auditKey) == 0 {
+			slog.Error("Audit signing key is not set", "env", CFG.MySQL.AuditKeyEnv)
+			os.Exit(EXIT_CONFIG)
+		}
+	}
+
+	if CFG.Pdftk.S3.Bucket != "" {
+		s3, err := newS3Store(CFG.Pdftk.S3)
+		if err != nil {
+			slog.Error("S3 upload unavailable", "err", err)
+			os.Exit(EXIT_CONFIG)
+		}
+		store = s3
+	}
+
+	bodyTemplate, err = planTemplate("Email.Bodytext", CFG.Email.Bodytext)
+	if err != nil {
+		fail(EXIT_CONFIG, "Bad Email.Bodytext", err)
+	}
+	if CFG.Pdftk.CoverTemplate != "" {
+		txt, err := os.ReadFile(CFG.Pdftk.CoverTemplate)
+		if err == nil {
+			coverTemplate, err = planTemplate(CFG.Pdftk.CoverTemplate, string(txt))
+		}
+		if err != nil {
+			fail(EXIT_CONFIG, "Bad Pdftk.CoverTemplate", err)
+		}
+	}
+
+	if CFG.Pdftk.SelfTest {
+		if err := selfTestPdftk(); err != nil {
+			slog.Error("pdftk self-test failed", "err", err)
+			os.Exit(EXIT_CONFIG)
+		}
+		slog.Debug("pdftk self-test passed")
+	}
+
+	slog.Debug("Opening database", "server", CFG.MySQL.Server)
+	if err := connectDatabase(); err != nil {
+		fail(EXIT_DATABASE, "Cannot connect to database "+CFG.MySQL.Database+" on "+CFG.MySQL.Server, err)
+	}
+	maxconns := CFG.MySQL.MaxConnections
+	if maxconns < 1 {
+		maxconns = DEFAULT_MAXCONNECTIONS
+	}
+	dbsem = make(chan struct{}, maxconns)
+	defer DBH.Close()
+	if err := checkDatabase(); err != nil {
+		fail(EXIT_DATABASE, "Database "+CFG.MySQL.Database+" is not usable", err)
+	}
+	if wantStage("secure") && !checkPlanDataSQL() {
+		os.Exit(EXIT_CONFIG)
+	}
+	if !checkStreamWheres() {
+		os.Exit(EXIT_CONFIG)
+	}
+	slog.Debug("Database opened")
+	CFG.Email.SendingUser = resolveSendingUser()
+
+	if *validateLtr != "" {
+		if !validateTemplate(*validateLtr) {
+			os.Exit(EXIT_CONFIG)
+		}
+		return
+	}
+
+	if *replayRun != "" {
+		if err := replayEmails(*replayRun); err != nil {
+			fail(EXIT_EMAIL, "Replay of run "+*replayRun+" failed", err)
+		}
+		return
+	}
+
+	if *sandboxPlan != "" {
+		if !runSandbox(*sandboxPlan) {
+			os.Exit(EXIT_CONFIG)
+		}
+		return
+	}
+
+	if *verifyRun != "" {
+		if !verifyAudit(*verifyRun) {
+			os.Exit(EXIT_CONFIG)
+		}
+		return
+	}
+
+	// Held until the run ends and its connection closes
+	runLock, err := lockRun()
+	if err != nil {
+		fail(EXIT_LOCKED, "Cannot start", err)
+	}
+	defer runLock.Close()
+
+	skipSecure := false
+	if CFG.Crninja.OnNoWork != NOWORK_PROCEED && !workWaiting() {
+		if CFG.Crninja.OnNoWork == NOWORK_EXIT {
+			slog.Info("Nothing to do")
+			writeReport(EXIT_NOWORK)
+			os.Exit(EXIT_NOWORK)
+		}
+		skipSecure = true
+	}
+
+	if wantStage("letters") || wantStage("dds") || wantStage("dd-format") {
+		if err := processStreams(); err != nil {
+			fail(EXIT_GENERATION, "Generation failed", err)
+		}
+	}
+	if wantStage("secure") && !skipSecure {
+		if err := makeSecurePDFs(); errors.Is(err, errTooManyFiles) {
+			fail(EXIT_MAXFILES, "Nothing secured, use -force to override", err)
+		} else if err != nil {
+			fail(EXIT_EMAIL, "Securing and emailing failed", err)
+		}
+	}
+	if dbCtx.Err() != nil {
+		exitInterrupted()
+	}
+	if runTimedOut() {
+		stopped := fmt.Sprintf("Run stopped after exceeding deadline of %v", *deadline)
+		slog.Warn(stopped, "skipped", nerrors)
+		notifyOperators(stopped)
+		writeReport(EXIT_DEADLINE)
+		os.Exit(EXIT_DEADLINE)
+	}
+	notifyOperators("")
+	writeReport(0)
+	if nerrors > 0 && errorFile != nil {
+		slog.Warn("Records skipped", "count", nerrors, "file", *errorPath)
+	} else if nerrors > 0 {
+		slog.Warn("Records skipped", "count", nerrors)
+	}
+	if stats.Reports+stats.ReportsFailed > 0 {
+		slog.Info("Reports run", "succeeded", stats.Reports, "failed", stats.ReportsFailed)
+	}
+	if *dryrun {
+		slog.Info("Dry run, nothing changed", "generated", stats.Generated, "secured", stats.Secured, "emailed", stats.Emailed)
+	}
+	slog.Info("Run complete")
+}
+
+// Alphabetic below
+
+// alreadySecured reports whether secured exists, isn't empty and is at
+// least as new as the original it would be made from
+func alreadySecured(original string, secured string) bool {
+
+	sfi, err := os.Stat(secured)
+	if err != nil {
+		return false
+	}
+	ofi, err := os.Stat(original)
+	return err == nil && sfi.Size() > 0 && !sfi.ModTime().Before(ofi.ModTime())
+}
+
+// applyEnvironment overrides settings from ENV_PREFIX variables
+func applyEnvironment() error {
+
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if len(name) <= len(ENV_PREFIX) || !strings.EqualFold(name[:len(ENV_PREFIX)], ENV_PREFIX) || value == "" {
+			continue
+		}
+		key := strings.ReplaceAll(name[len(ENV_PREFIX):], "_", ".")
+		if err := setConfig(key, value); err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		slog.Debug("Config set", "key", key, "from", name) // Not the value, it may be a password
+	}
+	return nil
+
+}
+
+// applyOverride sets one config value from a -set Section.Field=value,
+// parsing the value as it would be parsed in the YAML file
+func applyOverride(o string) error {
+
+	key, value, ok := strings.Cut(o, "=")
+	if !ok {
+		return fmt.Errorf("expected Section.Field=value")
+	}
+	if err := setConfig(key, value); err != nil {
+		return err
+	}
+	slog.Debug("Config set", "key", key, "value", value)
+	return nil
+
+}
+
+// audit records an action against a plan if an AuditTable is configured
+func audit(action string, planno string, detail string) error {
+
+	if CFG.MySQL.AuditTable == "" {
+		return nil
+	}
+	if auditKey == nil {
+		xsql := "INSERT INTO " + CFG.MySQL.AuditTable + " (RunID,LoggedAt,Action,PlanNo,Detail) VALUES("
+		xsql += "'" + safesql(runID) + "',Now(),'" + safesql(action) + "'," + sqlplanno(planno)
+		xsql += ",'" + safesql(detail) + "')"
+		return runsql(xsql)
+	}
+
+	auditSeq++
+	loggedAt := time.Now().Format(time.DateTime)
+	auditPrev = auditSignature(auditPrev, runID, auditSeq, loggedAt, action, planno, detail)
+	xsql := "INSERT INTO " + CFG.MySQL.AuditTable + " (RunID,Seq,LoggedAt,Action,PlanNo,Detail,Signature) VALUES("
+	xsql += "'" + safesql(runID) + "'," + strconv.Itoa(auditSeq) + ",'" + loggedAt + "','" + safesql(action) + "'," + sqlplanno(planno)
+	xsql += ",'" + safesql(detail) + "','" + auditPrev + "')"
+	return runsql(xsql)
+
+}
+
+// auditSignature signs one audit record, chained to the one before it
+func auditSignature(prev string, runid string, seq int, loggedAt string, action string, planno string, detail string) string {
+
+	mac := hmac.New(sha256.New, auditKey)
+	fmt.Fprintf(mac, "%v\t%v\t%v\t%v\t%v\t%v\t%v", prev, runid, seq, loggedAt, action, planno, detail)
+	return hex.EncodeToString(mac.Sum(nil))
+
+}
+
+func backgroundFirstPage(src string, blank string, dest string) error {
+
+	// pdftk can only apply a background to every page so we split off
+	// page 1, background that and then stitch the rest back on
+
+	p1 := strings.Replace(dest, ".pdf", "-p1.pdf", 1)
+	p1b := strings.Replace(dest, ".pdf", "-p1b.pdf", 1)
+	defer removeFile(p1)
+	defer removeFile(p1b)
+
+	if err := runPdftk([]string{src, "cat", "1", "output", p1}); err != nil {
+		return err
+	}
+	if err := runPdftk([]string{p1, "background", blank, "output", p1b}); err != nil {
+		return err
+	}
+	np, err := pdfPageCount(src, "")
+	if err != nil {
+		return err
+	}
+	if np < 2 {
+		return renameFile(p1b, dest)
+	}
+	return runPdftk([]string{"A=" + p1b, "B=" + src, "cat", "A", "B2-end", "output", dest})
+
+}
+
+// batchableFieldSQL reports whether a field's SQL will still give one
+// value per plan if we ask for several plans at once
+func batchableFieldSQL(fieldSQL string) bool {
+
+	x := strings.ToUpper(fieldSQL)
+	for _, kw := range []string{"WHERE", "GROUP", "ORDER", "LIMIT", "UNION", "HAVING", "SUM(", "COUNT(", "MIN(", "MAX(", "AVG("} {
+		if strings.Contains(x, kw) {
+			return false
+		}
+	}
+	return true
+
+}
+
+// buildMessage assembles a MIME message with optional attachments
+func buildMessage(to []string, subject string, body string, attachments []string) ([]byte, error) {
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	buf.WriteString(mimeHeader("From", CFG.Email.SMTP.From))
+	buf.WriteString(mimeHeader("To", strings.Join(to, ", ")))
+	buf.WriteString(mimeHeader("Subject", subject))
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n\r\n")
+
+	hdr := textproto.MIMEHeader{}
+	hdr.Set("Content-Type", "text/plain; charset=utf-8")
+	hdr.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := mw.CreatePart(hdr)
+	if err != nil {
+		return nil, err
+	}
+	eol := CFG.Email.SMTPLineEnding
+	if eol == "" {
+		eol = "crlf"
+	}
+	part.Write([]byte(mimeBody(normaliseLineEndings(body, eol))))
+
+	for _, att := range attachments {
+		data, err := os.ReadFile(att)
+		if err != nil {
+			return nil, err
+		}
+		ctype := mime.TypeByExtension(filepath.Ext(att))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		hdr := textproto.MIMEHeader{}
+		hdr.Set("Content-Type", ctype)
+		hdr.Set("Content-Transfer-Encoding", "base64")
+		hdr.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(att)}))
+		part, err := mw.CreatePart(hdr)
+		if err != nil {
+			return nil, err
+		}
+		enc := base64.StdEncoding.EncodeToString(data)
+		for len(enc) > 76 {
+			part.Write([]byte(enc[:76] + "\r\n"))
+			enc = enc[76:]
+		}
+		part.Write([]byte(enc + "\r\n"))
+	}
+	mw.Close()
+	return buf.Bytes(), nil
+
+}
+
+func checkDatabase() error {
+
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, "SELECT Count(*) FROM tliterals")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var res int64
+	if rows.Next() {
+		rows.Scan(&res)
+		slog.Debug("Query result", "sql", "SELECT Count(*) FROM tliterals", "count", res)
+	}
+	return rows.Err()
+}
+
+// checkPassword confirms that pdf won't open without a password but
+// will open with the one given
+func checkPassword(pdf string, password string) error {
+
+	args, err := pdfArgs([]string{pdf, "dump_data"})
+	if err != nil {
+		return err
+	}
+	if _, err := runner.Run(CFG.Pdftk.Exec, args...); err == nil {
+		return fmt.Errorf("%v opened without a password", pdf)
+	}
+	args, err = pdfArgs([]string{pdf, "input_pw", password, "dump_data"})
+	if err != nil {
+		return err
+	}
+	out, err := runner.Run(CFG.Pdftk.Exec, args...)
+	if err != nil {
+		return fmt.Errorf("decrypting with %v: %v %v", CFG.Pdftk.Exec, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+
+}
+
+// checkPlanDataSQL makes sure a configured Email.PlanDataSQL at least
+// runs and has the right number of columns
+func checkPlanDataSQL() bool {
+
+	if CFG.Email.PlanDataSQL == "" {
+		return true
+	}
+	xsql := "SELECT * FROM (" + strings.ReplaceAll(CFG.Email.PlanDataSQL, "#PlanNo#", sqlplanno("0")) + ") AS pd WHERE 1=0"
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, xsql)
+	if err != nil {
+		slog.Error("Email.PlanDataSQL failed", "err", err)
+		return false
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	returned := make(map[string]string)
+	for _, name := range planDataNames(cols) {
+		returned[name] = ""
+	}
+	if missing := missingColumns(returned); len(missing) > 0 {
+		slog.Error("Email.PlanDataSQL is missing columns", "returns", strings.Join(cols, ","), "missing", strings.Join(missing, ","))
+		return false
+	}
+	return true
+
+}
+
+// checkStreamWheres makes sure any stream Where conditions are a single
+// valid expression rather than something that could do damage
+func checkStreamWheres() bool {
+
+	ok := true
+	for _, whichq := range CFG.Crninja.Streams {
+		if whichq.Where == "" || !wantStream(whichq) {
+			continue
+		}
+		if strings.ContainsAny(whichq.Where, ";#") || strings.Contains(whichq.Where, "--") || strings.Contains(whichq.Where, "/*") {
+			slog.Error("Stream Where may not contain ; # -- or /*", "stream", whichq.Name)
+			ok = false
+			continue
+		}
+		xsql := "EXPLAIN SELECT 1 FROM " + whichq.Table + " WHERE (" + whichq.Where + ")"
+		slog.Debug("Query", "sql", xsql)
+		dbAcquire()
+		ctx, cancel := dbContext()
+		rows, err := DB.QueryContext(ctx, xsql)
+		if err == nil {
+			rows.Close()
+		}
+		cancel()
+		dbRelease()
+		if err != nil {
+			slog.Error("Stream Where is invalid", "stream", whichq.Name, "err", err)
+			ok = false
+		}
+	}
+	return ok
+
+}
+
+// claimableDelMeths lists, for SQL, the DelMeth codes which are not skipped
+func claimableDelMeths() string {
+
+	var codes []string
+	for code, how := range deliveryMethods() {
+		if how == DELIVER_SKIP {
+			continue
+		}
+		if _, err := strconv.Atoi(code); err == nil {
+			codes = append(codes, code)
+		} else {
+			codes = append(codes, "'"+safesql(code)+"'")
+		}
+	}
+	if len(codes) == 0 {
+		return "NULL"
+	}
+	slices.Sort(codes)
+	return strings.Join(codes, ",")
+
+}
+
+// claimBatch marks the stream's unprinted records as ours. Everything
+// happens in one transaction on one connection while holding a lock on
+// the stream, so concurrent runs can neither number nor claim the same
+// rows and a run that dies part way through claims nothing. The session
+// method's @B variable also survives between statements. With the
+// sequence method the starting batch number comes from the sequence
+// table rather than MaxSQL. Returns the numbers either side of the
+// claimed batches.
+func claimBatch(whichq STREAM, maxsql string, claimsql []string, lastsql string) (int64, int64, error) {
+
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	lock := "pdfwrap:" + safesql(whichq.Table)
+	xsql := strings.ReplaceAll(sqlDialect().LockSQL, "#Lock#", lock)
+	slog.Debug("Query", "sql", xsql)
+	var locked int64
+	if err = queryRow(ctx, tx, xsql, &locked); err != nil {
+		return 0, 0, err
+	}
+	if locked != 1 {
+		return 0, 0, fmt.Errorf("couldn't lock %v", whichq.Table)
+	}
+	if unlock := sqlDialect().UnlockSQL; unlock != "" {
+		// Session locks outlive the transaction so must go once it's over
+		defer func() {
+			tx.Rollback()
+			conn.ExecContext(ctx, strings.ReplaceAll(unlock, "#Lock#", lock))
+		}()
+	}
+
+	if err = reclaimAbandoned(ctx, tx, whichq); err != nil {
+		return 0, 0, err
+	}
+
+	seqtable := CFG.Crninja.SequenceTable
+	if seqtable == "" {
+		seqtable = DEFAULT_SEQUENCETABLE
+	}
+	seqname := "'" + safesql(whichq.Table) + "'"
+	sequenced := CFG.Crninja.BatchMethod == BATCH_SEQUENCE
+
+	var next sql.NullInt64
+	if sequenced {
+		xsql = "SELECT NextBatch FROM " + seqtable + " WHERE SeqName=" + seqname + " FOR UPDATE"
+		slog.Debug("Query", "sql", xsql)
+		err = queryRow(ctx, tx, xsql, &next)
+	}
+	if !sequenced || err == sql.ErrNoRows {
+		// First time for this stream so carry on from what's already there
+		err = queryRow(ctx, tx, expandStreamSQL(maxsql, whichq, 0), &next)
+		if err != nil {
+			return 0, 0, err
+		}
+		next.Int64++
+		if sequenced {
+			xsql = "INSERT INTO " + seqtable + " (SeqName,NextBatch) VALUES(" + seqname + "," + strconv.FormatInt(next.Int64, 10) + ")"
+			slog.Debug("Query", "sql", xsql)
+			_, err = tx.ExecContext(ctx, xsql)
+		}
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	batch := next.Int64 - 1
+	for _, xsql := range claimsql {
+		xsql = expandStreamSQL(xsql, whichq, batch)
+		slog.Debug("Query", "sql", xsql)
+		if _, err = tx.ExecContext(ctx, xsql); err != nil {
+			return 0, 0, err
+		}
+	}
+	var last sql.NullInt64
+	err = queryRow(ctx, tx, expandStreamSQL(lastsql, whichq, batch), &last)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if sequenced {
+		xsql = "UPDATE " + seqtable + " SET NextBatch=" + strconv.FormatInt(last.Int64, 10) + " WHERE SeqName=" + seqname
+		slog.Debug("Query", "sql", xsql)
+		if _, err = tx.ExecContext(ctx, xsql); err != nil {
+			return 0, 0, err
+		}
+	}
+	return batch, last.Int64, tx.Commit()
+
+}
+
+// compileMask turns PDFMask into a regexp according to MaskMode
+func compileMask(mask string) (*regexp.Regexp, error) {
+
+	res := mask
+	if strings.EqualFold(CFG.Pdftk.MaskMode, "glob") {
+		var sb strings.Builder
+		sb.WriteString("^")
+		inclass := false
+		for _, c := range mask {
+			switch {
+			case inclass:
+				sb.WriteRune(c)
+				inclass = c != ']'
+			case c == '*':
+				sb.WriteString(".*")
+			case c == '?':
+				sb.WriteString(".")
+			case c == '[':
+				sb.WriteRune(c)
+				inclass = true
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		sb.WriteString("$")
+		res = sb.String()
+	}
+	if CFG.Pdftk.MaskCaseInsensitive {
+		res = "(?i)" + res
+	}
+	return regexp.Compile(res)
+
+}
+
+// confirm asks the operator a yes/no question, assuming no if there's
+// nobody at the terminal to ask
+func confirm(question string) bool {
+
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Print(question + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+
+}
+
+// connectDatabase opens DBH, retrying as configured in case the database
+// isn't up yet
+func connectDatabase() error {
+
+	var err error
+	DBH, err = sql.Open(CFG.MySQL.Driver, sqlDialect().DSN())
+	if err != nil {
+		return err
+	}
+	DB = sqlDB{DBH}
+
+	delay := CFG.MySQL.ConnectDelay
+	if delay <= 0 {
+		delay = DEFAULT_CONNECTDELAY
+	}
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := dbContext()
+		err = DBH.PingContext(ctx)
+		cancel()
+		if err == nil || attempt >= CFG.MySQL.ConnectRetries {
+			break
+		}
+		slog.Warn("Database not available, retrying", "err", err, "delay", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+
+}
+
+// dateLayout turns a date format into a Go layout. Anything containing a
+// digit is taken to be a Go layout already, otherwise these tokens are
+// replaced: yyyy, yy, mmmm (January), mmm (Jan), mm, dddd (Monday), ddd
+// (Mon), dd, d, HH (24 hour), hh (12 hour), nn (minutes), ss and tt
+// (AM/PM). Anything else is kept as it is.
+func dateLayout(format string) string {
+
+	if strings.ContainsAny(format, "0123456789") {
+		return format
+	}
+	tokens := []string{"yyyy", "2006", "yy", "06", "mmmm", "January", "mmm", "Jan", "mm", "01",
+		"dddd", "Monday", "ddd", "Mon", "dd", "02", "d", "2", "HH", "15", "hh", "03", "nn", "04",
+		"ss", "05", "tt", "PM"}
+	return strings.NewReplacer(tokens...).Replace(format)
+
+}
+
+// dbAcquire must be called before any use of DB and matched by a call to
+// dbRelease once the query and any rows are finished with
+func dbAcquire() {
+
+	dbsem <- struct{}{}
+}
+
+// dbContext limits a query to MySQL.QueryTimeout
+func dbContext() (context.Context, context.CancelFunc) {
+
+	timeout := CFG.MySQL.QueryTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_QUERYTIMEOUT
+	}
+	return context.WithTimeout(dbCtx, timeout)
+
+}
+
+func dbRelease() {
+
+	<-dbsem
+}
+
+// deliveryMethods returns the configured DelMeth routing, or just email
+// for DELMETH_EMAIL if there isn't one
+func deliveryMethods() map[string]string {
+
+	if len(CFG.Crninja.DeliveryMethods) == 0 {
+		return map[string]string{DELMETH_EMAIL: DELIVER_EMAIL}
+	}
+	return CFG.Crninja.DeliveryMethods
+
+}
+
+// dumpConfiguration prints CFG, as merged by loadConfig and defaulted by
+// main, as YAML. Passwords, including the one in Crninja.DBAccess, are
+// redacted unless -showsecrets. S3 keys only ever come from the
+// environment so never appear.
+func dumpConfiguration() error {
+
+	cfg := CFG
+	if !*showSecrets {
+		for _, pw := range []*string{&cfg.MySQL.Password, &cfg.Pdftk.OwnerPass, &cfg.Email.SMTP.Password} {
+			if *pw != "" {
+				*pw = REDACTED
+			}
+		}
+		cfg.Crninja.DBAccess = strings.Join(redactArgs(strings.Split(cfg.Crninja.DBAccess, " ")), " ")
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+
+}
+
+// emailSecurePDF sends pdf, or several joined by ATTACHMENT_SEPARATOR,
+// npages being their total pages or 0 if not counted. Grouped documents
+// give the plan each is for in plans, otherwise they're all plandata's.
+func emailSecurePDF(pdf string, plans []string, plandata map[string]string, npages int) error {
+
+	fields := planFields(plandata)
+	if wantPageCount() {
+		fields["PageCount"] = ""
+		if npages > 0 {
+			fields["PageCount"] = strconv.Itoa(npages)
+		}
+	}
+	var sb strings.Builder
+	if err := bodyTemplate.Execute(&sb, fields); err != nil {
+		recordError("email", plandata[PD_PLANNO], fmt.Sprintf("Cannot fill in Email.Bodytext, %v", err))
+		return nil
+	}
+	BodyText := sb.String()
+
+	xsql := "INSERT INTO toutgoingemails (SentAt,SentBy,PlanNo,ToAddress"
+	if CFG.Email.Bcc != "" {
+		xsql += ",BCAddress"
+	}
+	smtpSend := CFG.Email.Delivery == DELIVERY_SMTP
+	xsql += ",Subject,MsgText,Attachments"
+	if smtpSend && CFG.Email.SentColumn != "" {
+		xsql += "," + CFG.Email.SentColumn
+	}
+	xsql += ") VALUES("
+	xsql += "Now(),'" + safesql(CFG.Email.SendingUser) + "'," + sqlplanno(plandata[PD_PLANNO])
+	if plandata[PD_EMAIL] == "" {
+		plandata[PD_EMAIL] = CFG.Email.BadEmailDefault
+	}
+	Subject := CFG.Email.Subject
+	if CFG.Email.TestRecipient != "" {
+		// Staging run so keep real customers out of it
+		Subject = "[" + plandata[PD_EMAIL] + "] " + Subject
+		plandata[PD_EMAIL] = CFG.Email.TestRecipient
+	}
+	xsql += ",'" + safesql(plandata[PD_EMAIL]) + "'"
+	if CFG.Email.Bcc != "" {
+		xsql += ",'" + safesql(CFG.Email.Bcc) + "'"
+	}
+	xsql += ",'" + safesql(Subject) + "'"
+	xsql += ",'" + safesql(normaliseLineEndings(BodyText, CFG.Email.StoredLineEnding)) + "'"
+	var attachments []string
+	for _, f := range strings.Split(pdf, ATTACHMENT_SEPARATOR) {
+		if ref, ok := storedAs[f]; ok {
+			f = ref
+		}
+		attachments = append(attachments, f)
+	}
+	xsql += ",'" + safesql(strings.Join(attachments, ATTACHMENT_SEPARATOR)) + "'"
+	if sandboxed {
+		fmt.Printf("Email to %v", plandata[PD_EMAIL])
+		if CFG.Email.Bcc != "" {
+			fmt.Printf(", bcc %v", CFG.Email.Bcc)
+		}
+		fmt.Printf("\nSubject: %v\nAttachments: %v\n\n%v\n", Subject, strings.Join(attachments, ATTACHMENT_SEPARATOR), BodyText)
+		return nil
+	}
+	if smtpSend {
+		to := []string{plandata[PD_EMAIL]}
+		var bcc []string
+		if CFG.Email.Bcc != "" {
+			bcc = append(bcc, CFG.Email.Bcc)
+		}
+		var err error
+		if *dryrun {
+			slog.Info("DRYRUN: not sent", "subject", Subject, "to", strings.Join(append(to, bcc...), ","))
+		} else {
+			err = sendMail(to, bcc, Subject, BodyText, strings.Split(pdf, ATTACHMENT_SEPARATOR))
+		}
+		// Recorded whether or not it went
+		sent := ""
+		if CFG.Email.SentColumn != "" {
+			sent = ",Now()"
+			if err != nil {
+				sent = ",NULL"
+			}
+		}
+		if err := runsql(xsql + sent + ")"); err != nil {
+			return err
+		}
+		if err != nil {
+			// Just this customer missing out so carry on with the rest
+			recordError("email", plandata[PD_PLANNO], fmt.Sprintf("Cannot send to %v, %v", plandata[PD_EMAIL], err))
+			return nil
+		}
+	} else if err := runsql(xsql + ")"); err != nil {
+		return err
+	}
+	stats.Emailed++
+	// Audited against each plan with its own documents
+	var audited []string
+	byplan := make(map[string][]string)
+	for i, f := range attachments {
+		planno := plandata[PD_PLANNO]
+		if i < len(plans) {
+			planno = plans[i]
+		}
+		if _, ok := byplan[planno]; !ok {
+			audited = append(audited, planno)
+		}
+		byplan[planno] = append(byplan[planno], f)
+	}
+	for _, planno := range audited {
+		if err := audit("email", planno, strings.Join(byplan[planno], ATTACHMENT_SEPARATOR)); err != nil {
+			return err
+		}
+	}
+
+	if CFG.Email.DeleteAfterEmail {
+		for _, f := range strings.Split(pdf, ATTACHMENT_SEPARATOR) {
+			removeFile(f)
+		}
+	}
+	return nil
+
+}
+
+// encryptionExempt reports whether documents for this product going to
+// this postcode must not be password protected
+func encryptionExempt(product string, postcode string) bool {
+
+	pc := strings.ToUpper(strings.ReplaceAll(postcode, " ", ""))
+	prefixes := slices.Concat(CFG.Pdftk.NoEncryptPostcodes["*"], CFG.Pdftk.NoEncryptPostcodes[product])
+	for _, prefix := range prefixes {
+		prefix = strings.ToUpper(strings.ReplaceAll(prefix, " ", ""))
+		if prefix != "" && strings.HasPrefix(pc, prefix) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// exitInterrupted ends a run the operator stopped, after telling them
+// how far it got
+func exitInterrupted() {
+
+	slog.Warn("Run interrupted", "skipped", nerrors)
+	notifyOperators("Run interrupted")
+	writeReport(EXIT_INTERRUPTED)
+	os.Exit(EXIT_INTERRUPTED)
+
+}
+
+// expandStreamSQL substitutes the stream specific placeholders in
+// a batch claiming statement
+func expandStreamSQL(xsql string, whichq STREAM, batch int64) string {
+
+	setPrinted := ""
+	if whichq.PrintedWhen != "" {
+		setPrinted = "," + whichq.PrintedWhen + "=" + sqldate(time.Now())
+	}
+	res := strings.ReplaceAll(xsql, "#Table#", whichq.Table)
+	res = strings.ReplaceAll(res, "#PrintedWhen#", whichq.PrintedWhen)
+	res = strings.ReplaceAll(res, "#SetPrinted#", setPrinted)
+	setClaimed := ""
+	if CFG.Crninja.ClaimColumn != "" {
+		setClaimed = "," + CFG.Crninja.ClaimColumn + "='" + safesql(runID) + "'"
+	}
+	res = strings.ReplaceAll(res, "#SetClaimed#", setClaimed)
+	res = strings.ReplaceAll(res, "#Today#", sqldate(time.Now()))
+	res = strings.ReplaceAll(res, "#DelMeth#", DELMETH_EMAIL)
+	res = strings.ReplaceAll(res, "#DelMeths#", claimableDelMeths())
+	res = strings.ReplaceAll(res, "#Batch#", strconv.FormatInt(batch, 10))
+	where := ""
+	if whichq.Where != "" {
+		where = " AND (" + whichq.Where + ")"
+	}
+	if *onePlan != "" {
+		where += " AND " + whichq.PlanNo + "=" + sqlplanno(*onePlan)
+	}
+	res = strings.ReplaceAll(res, "#Where#", where)
+	return res
+}
+
+// explainConfig describes what a run would do without doing any of it
+func explainConfig() {
+
+	onoff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+
+	fmt.Printf("Database %v on %v (%v) as %v\n", CFG.MySQL.Database, CFG.MySQL.Server, CFG.MySQL.Driver, CFG.MySQL.Userid)
+	fmt.Printf("Documents are written to %v\n", outputFolderName())
+	if *onePlan != "" {
+		fmt.Printf("Only plan %v is generated and secured\n", *onePlan)
+	}
+	if len(CFG.Crninja.DeliveryMethods) > 0 {
+		var codes []string
+		for code := range CFG.Crninja.DeliveryMethods {
+			codes = append(codes, code)
+		}
+		slices.Sort(codes)
+		for _, code := range codes {
+			fmt.Printf("DelMeth %v is handled as %v\n", code, CFG.Crninja.DeliveryMethods[code])
+		}
+	}
+	if !CFG.Pdftk.NoUserPassword {
+		if CFG.Pdftk.PasswordFallback != "" {
+			fmt.Printf("Documents are secured with the plan's %v, or %v if that's empty\n", CFG.Pdftk.PasswordField, CFG.Pdftk.PasswordFallback)
+		} else {
+			fmt.Printf("Documents are secured with the plan's %v\n", CFG.Pdftk.PasswordField)
+		}
+	}
+	if CFG.Pdftk.S3.Bucket != "" {
+		fmt.Printf("Secured documents are uploaded to s3://%v/%v, keeping local copies %v\n", CFG.Pdftk.S3.Bucket, CFG.Pdftk.S3.Prefix, onoff(CFG.Pdftk.S3.KeepLocal))
+	}
+
+	for _, whichq := range CFG.Crninja.Streams {
+		if !wantStream(whichq) {
+			continue
+		}
+		if whichq.FormatPage2 && (wantStage("dds") || wantStage("dd-format")) {
+			fmt.Printf("Formatting writes letter %v into %v records with edited=0\n", whichq.Page2.Page2Ltr, whichq.Table)
+		}
+		if wantStage(streamStage(whichq)) {
+			fmt.Printf("Stream %v (%v):\n", whichq.Name, streamStage(whichq))
+			fmt.Printf("  claims records in %v with DelMeth in (%v) and PrintBatch=0", whichq.Table, claimableDelMeths())
+			if whichq.PrintedWhen != "" {
+				fmt.Printf(", setting %v", whichq.PrintedWhen)
+			} else if CFG.MySQL.PrintLogTable != "" {
+				fmt.Printf(", logging them in %v", CFG.MySQL.PrintLogTable)
+			}
+			fmt.Println()
+			method := CFG.Crninja.BatchMethod
+			if method == "" {
+				method = BATCH_SESSION
+			}
+			fmt.Printf("  batch numbering: %v\n", method)
+			if CFG.Crninja.ClaimColumn != "" {
+				after := CFG.Crninja.ReclaimAfter
+				if after <= 0 {
+					after = DEFAULT_RECLAIMAFTER
+				}
+				fmt.Printf("  marks claimed records in %v, reclaiming any abandoned for over %v\n", CFG.Crninja.ClaimColumn, after)
+			}
+			if CFG.Crninja.Workers > 1 {
+				fmt.Printf("  generates up to %v documents at once\n", CFG.Crninja.Workers)
+			}
+			fmt.Printf("  runs %v with report %v", CFG.Crninja.Exec, whichq.Rpt)
+			if whichq.ExtraRpt != "" {
+				fmt.Printf(" then %v", whichq.ExtraRpt)
+			}
+			fmt.Println()
+			if whichq.Blank != "" {
+				fmt.Printf("  applies background %v", whichq.Blank)
+				if whichq.BackgroundFirstPageOnly {
+					fmt.Print(" to page 1 only")
+				}
+				fmt.Println()
+			}
+			if whichq.ApplyStatus {
+				fmt.Println("  skips plans whose RecordStatus is mapped to skip or review")
+			}
+		}
+	}
+
+	if wantStage("secure") {
+		fmt.Printf("Securing scans %v for %v (%v), recursive %v\n", outputFolderName(), CFG.Pdftk.PDFMask, maskModeName(), onoff(CFG.Pdftk.Recursive))
+		fmt.Printf("  reads customer details from %v\n", planDataSource())
+		fmt.Printf("  runs %v to add terms, metadata and passwords\n", CFG.Pdftk.Exec)
+		if CFG.Pdftk.CoverTemplate != "" {
+			fmt.Printf("  runs %v to make cover pages from %v\n", CFG.Pdftk.CoverRenderer, CFG.Pdftk.CoverTemplate)
+		}
+		if CFG.Pdftk.Stamp != "" {
+			fmt.Printf("  stamps every page with %v\n", CFG.Pdftk.Stamp)
+		}
+		if CFG.Email.Delivery == DELIVERY_SMTP {
+			fmt.Printf("  sends emails via %v as %v", CFG.Email.SMTP.Host, CFG.Email.SMTP.From)
+		} else {
+			fmt.Print("  queues emails in toutgoingemails")
+		}
+		if CFG.Email.TestRecipient != "" {
+			fmt.Printf(", all redirected to %v", CFG.Email.TestRecipient)
+		}
+		fmt.Println()
+		if len(CFG.Email.DigestProducts) > 0 {
+			fmt.Printf("  sends one email per address for %v\n", strings.Join(CFG.Email.DigestProducts, ", "))
+		}
+		if CFG.Email.DeleteAfterEmail {
+			fmt.Println("  deletes secured documents once emailed")
+		}
+	}
+
+	fmt.Println("Safety guards:")
+	fmt.Printf("  deadline: %v\n", *deadline)
+	fmt.Printf("  MaxFiles: %v, -force %v\n", CFG.Pdftk.MaxFiles, onoff(*force))
+	fmt.Printf("  when no work is waiting: %v\n", CFG.Crninja.OnNoWork)
+	policy := CFG.Pdftk.ExistsPolicy
+	if policy == "" {
+		policy = EXISTS_OVERWRITE
+	}
+	fmt.Printf("  existing documents: %v\n", policy)
+	fmt.Printf("  pdftk self-test: %v\n", onoff(CFG.Pdftk.SelfTest))
+	fmt.Printf("  password check before emailing: %v\n", onoff(CFG.Pdftk.VerifyPassword))
+	fmt.Printf("  encryption exemptions: %v\n", len(CFG.Pdftk.NoEncryptPostcodes))
+	if CFG.Pdftk.ReviewFolder != "" {
+		fmt.Printf("  review folder: %v\n", reviewFolder())
+	}
+	if CFG.MySQL.AuditTable != "" {
+		fmt.Printf("  audit table: %v, signed %v\n", CFG.MySQL.AuditTable, onoff(CFG.MySQL.AuditKeyEnv != ""))
+	}
+
+}
+
+// fail ends a run that can't continue with one of the EXIT_ codes. The
+// operator sees msg and the underlying cause; -debug shows the whole
+// chain of errors leading to it.
+func fail(code int, msg string, err error) {
+
+	if dbCtx != nil && dbCtx.Err() != nil {
+		exitInterrupted()
+	}
+	cause := err
+	for errors.Unwrap(cause) != nil {
+		cause = errors.Unwrap(cause)
+	}
+	slog.Error(msg, "err", cause)
+	if cause != err {
+		slog.Debug(msg, "err", err)
+	}
+	notifyOperators(fmt.Sprintf("%v: %v", msg, cause))
+	writeReport(code)
+	os.Exit(code)
+
+}
+
+// fieldValue formats a raw letter field value as replaceFields does
+func fieldValue(fld string, fieldType int64, raw string) string {
+
+	switch fieldType {
+	case FIELD_VALUE_TYPE_CURRENCY:
+		xval, _ := strconv.ParseFloat(raw, 64)
+		return formatCurrency(xval)
+	case FIELD_VALUE_TYPE_DATE:
+		return formatDate(raw, fld)
+	case FIELD_VALUE_TYPE_INTEGER:
+		xval, _ := strconv.ParseInt(raw, 10, 64)
+		return strconv.FormatInt(xval, 10)
+	}
+	return raw
+
+}
+
+// firstLines returns up to n non-blank lines of txt run together
+func firstLines(txt string, n int) string {
+
+	var res []string
+	for _, line := range strings.Split(txt, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			res = append(res, line)
+		}
+		if len(res) >= n {
+			break
+		}
+	}
+	return strings.Join(res, " / ")
+
+}
+
+// formatCurrency renders an amount as, eg, £1,234.50 or -£12.00
+func formatCurrency(amount float64) string {
+
+	symbol := CFG.Email.CurrencySymbol
+	if symbol == "" {
+		symbol = DEFAULT_CURRENCY_SYMBOL
+	}
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	digits := strconv.FormatFloat(amount, 'f', 2, 64)
+	whole, pence, _ := strings.Cut(digits, ".")
+	var sb strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteRune(c)
+	}
+	if sign == "-" && sb.String() == "0" && pence == "00" {
+		sign = "" // Don't show -0.00 for tiny negatives
+	}
+	return sign + symbol + sb.String() + "." + pence
+
+}
+
+// formatDate renders a date field value as configured for the field,
+// returning it unchanged if it isn't a date we recognise
+func formatDate(dt string, fld string) string {
+
+	layouts := CFG.Email.DateInputFormats
+	if len(layouts) == 0 {
+		layouts = DEFAULT_DATE_LAYOUTS
+	}
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, strings.TrimSpace(dt))
+		if err != nil {
+			continue
+		}
+		format := CFG.Email.DateFormat
+		if format == "" {
+			format = DEFAULT_DATE_FORMAT
+		}
+		if t.Hour()+t.Minute()+t.Second() != 0 && CFG.Email.DateTimeFormat != "" {
+			format = CFG.Email.DateTimeFormat
+		}
+		if f, ok := CFG.Email.FieldDateFormats[fld]; ok {
+			format = f
+		}
+		return t.Format(dateLayout(format))
+	}
+	slog.Warn("Not a recognised date, used as is", "field", fld, "value", dt)
+	return dt
+}
+
+func formatDDPage2s(whichq STREAM) error {
+
+	// This formats the stream's Page2 standard letter into each of its
+	// records (DD_NOTIFY for DD notices) ready for printing
+
+	// Better to stop than fill records with unresolved [[fields]]
+	if _, err := letterField(""); err != nil {
+		return err
+	}
+	page2 := whichq.Page2
+	bodyText := getStringFromDB("SELECT LtrBody "+FETCHTEXT, "", page2.Page2Ltr)
+	headText := ""
+	if page2.HeaderColumn != "" {
+		headText = getStringFromDB("SELECT HdrHeader "+FETCHTEXT, "", page2.Page2Ltr)
+	}
+	footText := ""
+	if page2.FooterColumn != "" {
+		footText = getStringFromDB("SELECT FtrFooter "+FETCHTEXT, "", page2.Page2Ltr)
+	}
+	bodyColumn := page2.BodyColumn
+	if bodyColumn == "" {
+		bodyColumn = "ltr2Body"
+	}
+	var page2s = make(map[int]string)
+
+	xsql := "SELECT ID, AccountRef FROM " + whichq.Table + " WHERE edited=0"
+	if *onePlan != "" {
+		xsql += " AND AccountRef=" + sqlplanno(*onePlan)
+	}
+	slog.Debug("Query", "sql", xsql)
+	dbAcquire()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, xsql)
+	if err != nil {
+		dbRelease()
+		return err
+	}
+	for rows.Next() {
+		var id int
+		var account string
+		rows.Scan(&id, &account)
+		page2s[id] = account
+	}
+	rows.Close()
+	dbRelease()
+
+	plans := make([]string, 0, len(page2s))
+	for _, plan := range page2s {
+		plans = append(plans, plan)
+	}
+	prefetchFields(bodyText+headText+footText, plans)
+	defer clear(fieldCache)
+
+	for id, plan := range page2s {
+		if runTimedOut() {
+			return nil
+		}
+		body, err := replaceFields(bodyText, plan)
+		if err != nil {
+			return err
+		}
+		xsql := "UPDATE " + whichq.Table + " SET " + bodyColumn + "='" + safesql(body) + "'"
+		if page2.HeaderColumn != "" {
+			head, err := replaceFields(headText, plan)
+			if err != nil {
+				return err
+			}
+			xsql += "," + page2.HeaderColumn + "='" + safesql(head) + "'"
+		}
+		if page2.FooterColumn != "" {
+			foot, err := replaceFields(footText, plan)
+			if err != nil {
+				return err
+			}
+			xsql += "," + page2.FooterColumn + "='" + safesql(foot) + "'"
+		}
+		xsql += " WHERE id=" + strconv.Itoa(id)
+		if err := runsql(xsql); err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// generateDocument produces the finished PDF for one queued record,
+// returning its name or "" if it wasn't generated
+func generateDocument(whichq STREAM, q queued, batch int64, outFolder string) string {
+
+	PlanNo := q.PlanNo
+	Ltrid := q.Ltrid
+	if whichq.ApplyStatus {
+		status := getStringFromDB("SELECT RecordStatus FROM tcustomers WHERE PlanNo=?", "", PlanNo)
+		action, _ := statusAction(status)
+		if action == STATUS_SKIP || action == STATUS_REVIEW {
+			recordError("generate", PlanNo, fmt.Sprintf("Plan %v letter %v not generated, status %v is %v", PlanNo, Ltrid, status, action))
+			return ""
+		}
+	}
+	docFolder, tag := outFolder, ""
+	if len(CFG.Crninja.DeliveryMethods) > 0 {
+		switch deliveryMethods()[q.DelMeth] {
+		case DELIVER_PAPER:
+			docFolder = paperFolder()
+			if !*dryrun {
+				if err := os.MkdirAll(docFolder, 0755); err != nil {
+					recordError("generate", PlanNo, fmt.Sprintf("Plan %v letter %v not generated, %v", PlanNo, Ltrid, err))
+					return ""
+				}
+			}
+		case DELIVER_PORTAL:
+			tag = PORTAL_SUFFIX
+		}
+	}
+	fname := filepath.Join(docFolder, CFG.Pdftk.PDFPrefix+PlanNo+"-"+Ltrid+tag+"-draft.pdf")
+	fname2 := strings.Replace(fname, "-draft.pdf", ".pdf", 1)
+	if _, err := os.Stat(fname2); err == nil {
+		switch CFG.Pdftk.ExistsPolicy {
+		case EXISTS_SKIP:
+			recordError("generate", PlanNo, fmt.Sprintf("%v already exists, not regenerated", fname2))
+			return ""
+		case EXISTS_SUFFIX:
+			old := fname2
+			fname2 = uniqueFilename(fname2)
+			fname = strings.Replace(fname2, ".pdf", "-draft.pdf", 1)
+			slog.Info("Already exists, generating a new file", "PlanNo", PlanNo, "Filename", old, "new", fname2)
+		default:
+			slog.Info("Already exists, overwriting", "PlanNo", PlanNo, "Filename", fname2)
+		}
+	}
+
+	// Now run CrystalReportsNinja to generate the PDF
+	if problem := runCrninja(whichq.Rpt, fname, batch, q.Params); problem != "" {
+		if fi, err := os.Stat(fname); err != nil || fi.Size() == 0 {
+			// Nothing worth reviewing, eg the report found no data
+			removeFile(fname)
+			recordError("generate", PlanNo, fmt.Sprintf("Plan %v letter %v skipped, %v", PlanNo, Ltrid, problem))
+			return ""
+		}
+		routeToReview(fname, PlanNo, "letter "+Ltrid+", "+problem)
+		return ""
+	}
+
+	if whichq.ExtraRpt != "" {
+		extra := strings.Replace(fname, "-draft.pdf", "-extra.pdf", 1)
+		both := strings.Replace(fname, "-draft.pdf", "-both.pdf", 1)
+		if problem := runCrninja(whichq.ExtraRpt, extra, batch, q.Params); problem != "" {
+			routeToReview(fname, PlanNo, "letter "+Ltrid+", "+problem)
+			removeFile(extra)
+			return ""
+		}
+		err := runPdftk([]string{fname, extra, "cat", "output", both})
+		removeFile(extra)
+		if err != nil {
+			routeToReview(fname, PlanNo, err.Error())
+			return ""
+		}
+		if err := renameFile(both, fname); err != nil {
+			routeToReview(both, PlanNo, err.Error())
+			return ""
+		}
+	}
+
+	var err error
+	if whichq.Blank != "" && whichq.BackgroundFirstPageOnly {
+		err = backgroundFirstPage(fname, filepath.Join(CFG.Pdftk.Folder, whichq.Blank), fname2)
+	} else {
+		args := []string{fname}
+		if whichq.Blank != "" {
+			args = append(args, "background", filepath.Join(CFG.Pdftk.Folder, whichq.Blank))
+		}
+		args = append(args, "output", fname2)
+		err = runPdftk(args)
+	}
+	if err != nil {
+		routeToReview(fname, PlanNo, err.Error())
+		return ""
+	}
+	removeFile(fname)
+	return fname2
+
+}
+
+func generatePDFs(whichq STREAM) error {
+
+	// Need to process letter queue one record at a time so ...
+	// First, mark the whole batch as belonging to me
+
+	maxsql := whichq.MaxSQL
+	if maxsql == "" {
+		maxsql = DEFAULT_MAXSQL
+	}
+	claimsql := whichq.ClaimSQL
+	if len(claimsql) == 0 {
+		claimsql = sqlDialect().ClaimSQL
+	}
+	lastsql := whichq.LastSQL
+	if lastsql == "" {
+		lastsql = sqlDialect().LastSQL
+	}
+
+	if runTimedOut() {
+		return nil
+	}
+
+	var Batch2Print, LastBatch int64
+	var err error
+	if *dryrun {
+		// Nothing gets claimed so work on what would have been
+		Batch2Print = getIntegerFromDB(expandStreamSQL(maxsql, whichq, 0), 0)
+		for _, xsql := range claimsql {
+			runsql(expandStreamSQL(xsql, whichq, Batch2Print))
+		}
+	} else {
+		Batch2Print, LastBatch, err = claimBatch(whichq, maxsql, claimsql, lastsql)
+		if err != nil {
+			return fmt.Errorf("claiming %v: %w", whichq.Name, err)
+		}
+		if LastBatch > Batch2Print {
+			stats.Batches = append(stats.Batches, claimedRange{whichq.Name, Batch2Print + 1, LastBatch})
+		}
+	}
+	claimed := "PrintBatch > " + strconv.FormatInt(Batch2Print, 10) + " AND PrintBatch <= " + strconv.FormatInt(LastBatch, 10)
+	generated := false
+	defer func() {
+		// Leaving before generation so hand the whole batch back for next time
+		if !generated && !*dryrun {
+			if err := releaseClaims(whichq, claimed); err != nil {
+				slog.Error("Cannot release claimed records", "stream", whichq.Name, "err", err)
+			}
+		}
+	}()
+
+	if whichq.PrintedWhen == "" && CFG.MySQL.PrintLogTable != "" {
+		xsql := "INSERT INTO " + CFG.MySQL.PrintLogTable + " (RunID,Stream,PlanNo,PrintBatch,PrintedAt)"
+		xsql += " SELECT '" + safesql(runID) + "','" + safesql(whichq.Name) + "'," + whichq.PlanNo + ",PrintBatch,Now()"
+		xsql += " FROM " + whichq.Table
+		xsql += " WHERE " + claimed
+		if err := runsql(xsql); err != nil {
+			return err
+		}
+	}
+
+	// Now loop through that marked batch
+	var batch []queued
+	if *dryrun {
+		batch, err = queuedRecords(whichq, expandStreamSQL("PrintBatch=0 AND DelMeth IN (#DelMeths#)#Where#", whichq, 0))
+	} else {
+		batch, err = queuedRecords(whichq, claimed)
+	}
+	if err != nil {
+		return fmt.Errorf("reading %v: %w", whichq.Name, err)
+	}
+
+	outFolder, err := outputFolder()
+	if err != nil {
+		return err
+	}
+	made := make([]string, len(batch))  // Filename generated for each record
+	skipped := make([]bool, len(batch)) // Not started before the deadline
+	var crashed error                   // From the first worker to panic
+	generate := func(i int) {
+		if runTimedOut() {
+			skipped[i] = true
+			return
+		}
+		// Each record was claimed with its own batch number
+		pb := batch[i].PrintBatch
+		if *dryrun {
+			pb = Batch2Print + int64(i) + 1
+		}
+		made[i] = generateDocument(whichq, batch[i], pb, outFolder)
+	}
+
+	workers := CFG.Crninja.Workers
+	if workers <= 1 {
+		for i := range batch {
+			generate(i)
+		}
+	} else {
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		var crashMu sync.Mutex
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					func() {
+						// Don't let one bad record take the others down with
+						// it, but fail the run once they're done
+						defer func() {
+							if r := recover(); r != nil {
+								recordError("generate", batch[i].PlanNo, fmt.Sprintf("Plan %v letter %v failed: %v", batch[i].PlanNo, batch[i].Ltrid, r))
+								slog.Error("Generation panicked", "PlanNo", batch[i].PlanNo, "Ltrid", batch[i].Ltrid, "stack", string(runtimedebug.Stack()))
+								crashMu.Lock()
+								if crashed == nil {
+									crashed = fmt.Errorf("plan %v letter %v panicked: %v", batch[i].PlanNo, batch[i].Ltrid, r)
+								}
+								crashMu.Unlock()
+							}
+						}()
+						generate(i)
+					}()
+				}
+			}()
+		}
+		for i := range batch {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+	}
+	generated = true
+
+	var spooled [][3]string // PlanNo, Ltrid, filename
+	var giveback []string
+	ndox := 0
+	for i, q := range batch {
+		if skipped[i] {
+			giveback = append(giveback, strconv.FormatInt(q.PrintBatch, 10))
+			continue
+		}
+		if made[i] == "" {
+			continue
+		}
+		ndox++
+		if whichq.Spool {
+			spooled = append(spooled, [3]string{q.PlanNo, q.Ltrid, made[i]})
+		}
+	}
+	if len(giveback) > 0 {
+		// Give back whatever we didn't get round to
+		if err := releaseClaims(whichq, "PrintBatch IN ("+strings.Join(giveback, ",")+")"); err != nil {
+			return err
+		}
+	}
+	if CFG.Crninja.ClaimColumn != "" {
+		// Everything left is dealt with so won't need reclaiming
+		if err := runsql("UPDATE " + whichq.Table + " SET " + CFG.Crninja.ClaimColumn + "=NULL WHERE " + CFG.Crninja.ClaimColumn + "='" + safesql(runID) + "'"); err != nil {
+			return err
+		}
+	}
+	if len(spooled) > 0 && *dryrun {
+		slog.Info("DRYRUN: not spooled", "stream", whichq.Name, "count", len(spooled))
+	} else if len(spooled) > 0 {
+		makeSpool(whichq, outFolder, spooled)
+	}
+	stats.Generated += ndox
+	slog.Info("PDFs generated", "stream", whichq.Name, "count", ndox)
+	return crashed
+
+}
+
+func getFloatFromDB(xsql string, xdef float64, args ...any) float64 {
+
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, rebind(xsql), args...)
+	if err != nil {
+		logQueryError(err, xsql)
+		return xdef
+	}
+	defer rows.Close()
+	var res sql.NullFloat64
+	if !rows.Next() {
+		return xdef
+	}
+	if err := rows.Scan(&res); err != nil {
+		logQueryError(err, xsql)
+		return xdef
+	}
+	if !res.Valid {
+		slog.Debug("Query result is NULL, using default", "default", xdef)
+		return xdef
+	}
+	return res.Float64
+
+}
+
+func getIntegerFromDB(xsql string, xdef int64, args ...any) int64 {
+
+	slog.Debug("Query", "sql", xsql, "args", args)
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, rebind(xsql), args...)
+	if err != nil {
+		logQueryError(err, xsql)
+		return xdef
+	}
+	defer rows.Close()
+	var res sql.NullInt64
+	if !rows.Next() {
+		slog.Debug("Query returned no rows, using default", "default", xdef)
+		return xdef
+	}
+	if err := rows.Scan(&res); err != nil {
+		logQueryError(err, xsql)
+		return xdef
+	}
+	if !res.Valid {
+		slog.Debug("Query result is NULL, using default", "default", xdef)
+		return xdef
+	}
+	slog.Debug("Query result", "value", res.Int64)
+	return res.Int64
+}
+
+// getPlanData fetches the customer details needed to secure and email
+// a plan's documents, see planDataColumns
+func getPlanData(planno string) map[string]string {
+
+	if CFG.Email.PlanDataSQL != "" {
+		return getPlanDataCustom(planno)
+	}
+
+	// Schemas without a stored password still get an (empty) one
+	customerPassword := "COALESCE(CustomerPassword,'')"
+	if CFG.Email.NoCustomerPassword {
+		customerPassword = "''"
+	}
+
+	// In the order of planDataColumns
+	cols := []string{"COALESCE(Product,?)", "COALESCE(cEmail,?)",
+		"COALESCE(cPhone,'')", "COALESCE(cPostcode,'')",
+		"COALESCE(cTitle,'')",
+		"COALESCE(cFirstname,'')",
+		"COALESCE(cLastname,'')",
+		customerPassword,
+		"RecordStatus", "PlanNo"}
+	names := slices.Clone(planDataColumns)
+	for _, col := range CFG.Email.ExtraPlanColumns {
+		if col != "" && !slices.Contains(names, col) {
+			cols = append(cols, "COALESCE("+col+",'')")
+			names = append(names, col)
+		}
+	}
+	pdsql := "SELECT " + strings.Join(cols, ",") + " FROM tcustomers WHERE PlanNo=?"
+
+	return queryPlanData(pdsql, names, CFG.Email.BadProductDefault, CFG.Email.BadEmailDefault, planno)
+
+}
+
+// getPlanDataCustom runs the configured Email.PlanDataSQL. A result
+// missing any of planDataColumns is returned as nil.
+func getPlanDataCustom(planno string) map[string]string {
+
+	xsql := strings.ReplaceAll(CFG.Email.PlanDataSQL, "#PlanNo#", sqlplanno(planno))
+	res := queryPlanData(xsql, nil)
+	if res == nil || len(missingColumns(res)) > 0 {
+		return nil
+	}
+	if res[PD_PRODUCT] == "" {
+		res[PD_PRODUCT] = CFG.Email.BadProductDefault
+	}
+	if res[PD_EMAIL] == "" {
+		res[PD_EMAIL] = CFG.Email.BadEmailDefault
+	}
+	return res
+
+}
+
+func getStringFromDB(xsql string, xdef string, args ...any) string {
+
+	slog.Debug("Query", "sql", xsql, "args", args)
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, rebind(xsql), args...)
+	if err != nil {
+		logQueryError(err, xsql)
+		return xdef
+	}
+	defer rows.Close()
+	var res sql.NullString
+	if !rows.Next() {
+		slog.Debug("Query returned no rows, using default", "default", xdef)
+		return xdef
+	}
+	if err := rows.Scan(&res); err != nil {
+		logQueryError(err, xsql)
+		return xdef
+	}
+	if !res.Valid {
+		slog.Debug("Query result is NULL, using default", "default", xdef)
+		return xdef
+	}
+	slog.Debug("Query result", "value", res.String)
+	return res.String
+
+}
+
+// infoEscape writes a value as pdftk's dump_data does, with markup
+// characters and anything beyond ASCII as XML entities. Each line is one
+// key or value in the info file so line breaks and tabs become spaces
+// and any other control characters are dropped.
+func infoEscape(val string) string {
+
+	var sb strings.Builder
+	val = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", "\t", " ").Replace(val)
+	for _, r := range val {
+		switch {
+		case r < ' ':
+			// Dropped
+		case r == '&':
+			sb.WriteString("&amp;")
+		case r == '<':
+			sb.WriteString("&lt;")
+		case r == '>':
+			sb.WriteString("&gt;")
+		case r == '"':
+			sb.WriteString("&quot;")
+		case r > '~':
+			fmt.Fprintf(&sb, "&#%d;", r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// letterField returns the definition of a [[field]], reading the whole
+// of tstdletterfields the first time it's called. Unknown fields have no
+// SQL. If the table can't be read no field can be filled in so every
+// call fails.
+func letterField(fld string) (fieldDef, error) {
+
+	fieldDefsOnce.Do(func() {
+		fieldDefs = make(map[string]fieldDef)
+		xsql := "SELECT FieldID,FieldSQL,FieldValueType FROM tstdletterfields"
+		slog.Debug("Query", "sql", xsql)
+		dbAcquire()
+		defer dbRelease()
+		ctx, cancel := dbContext()
+		defer cancel()
+		rows, err := DB.QueryContext(ctx, xsql)
+		if err != nil {
+			logQueryTimeout(err, xsql)
+			fieldDefsErr = fmt.Errorf("reading letter field definitions: %w", err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, fieldSQL sql.NullString
+			var fieldType sql.NullInt64
+			if err := rows.Scan(&id, &fieldSQL, &fieldType); err != nil {
+				fieldDefsErr = fmt.Errorf("reading letter field definitions: %w", err)
+				return
+			}
+			fieldDefs[strings.ToLower(id.String)] = fieldDef{SQL: fieldSQL.String, Type: fieldType.Int64}
+		}
+		if err := rows.Err(); err != nil {
+			fieldDefsErr = fmt.Errorf("reading letter field definitions: %w", err)
+			return
+		}
+		slog.Debug("Letter fields defined", "count", len(fieldDefs))
+	})
+	if fieldDefsErr != nil {
+		return fieldDef{}, fieldDefsErr
+	}
+	return fieldDefs[strings.ToLower(fld)], nil
+
+}
+
+// listFolder returns the paths, relative to folder, of the files in it
+// and optionally its subfolders
+func listFolder(folder string, recursive bool) []string {
+
+	var res []string
+	if !recursive {
+		files, _ := os.ReadDir(folder)
+		for _, file := range files {
+			if !file.IsDir() {
+				res = append(res, file.Name())
+			}
+		}
+		return res
+	}
+	filepath.WalkDir(folder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Debug("Can't scan", "path", path, "err", err)
+			return nil
+		}
+		if d.IsDir() {
+			if CFG.Pdftk.ReviewFolder != "" && path == reviewFolder() {
+				return filepath.SkipDir
+			}
+			if path == filepath.Join(folder, SKIPPED_FOLDER) {
+				return filepath.SkipDir
+			}
+			if CFG.Pdftk.PaperFolder != "" && path == paperFolder() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(folder, path)
+		if err == nil {
+			res = append(res, rel)
+		}
+		return nil
+	})
+	return res
+
+}
+
+func loadConfig() error {
+
+	d := yaml.NewDecoder(strings.NewReader(mycfg))
+
+	cfgp := &CFG
+
+	if err := d.Decode(&cfgp); err != nil {
+		return fmt.Errorf("embedded configuration: %w", err)
+	}
+
+	if *configPath == "" {
+		return nil
+	}
+	file, err := os.Open(*configPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	slog.Info("Parsing", "config", *configPath)
+
+	// Start YAML decoding from file
+	d = yaml.NewDecoder(file)
+
+	if err := d.Decode(&cfgp); err != nil {
+		return fmt.Errorf("%v: %w", *configPath, err)
+	}
+	return nil
+}
+
+// lockRun takes the run lock for this database, waiting up to
+// MySQL.RunLockWait if another run has it. The lock is released when
+// the returned connection is closed.
+func lockRun() (DBConn, error) {
+
+	lock := "pdfwrap:" + safesql(CFG.MySQL.Database)
+	xsql := strings.ReplaceAll(sqlDialect().TryLockSQL, "#Lock#", lock)
+	conn, err := DB.Conn(dbCtx)
+	if err != nil {
+		return nil, err
+	}
+	waitUntil := time.Now().Add(CFG.MySQL.RunLockWait)
+	for {
+		slog.Debug("Query", "sql", xsql)
+		var locked int64
+		if err := queryRow(dbCtx, conn, xsql, &locked); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if locked == 1 {
+			return conn, nil
+		}
+		if !time.Now().Before(waitUntil) {
+			conn.Close()
+			return nil, fmt.Errorf("another run is in progress on %v", CFG.MySQL.Database)
+		}
+		slog.Info("Waiting for another run to finish", "database", CFG.MySQL.Database)
+		select {
+		case <-dbCtx.Done():
+			conn.Close()
+			return nil, dbCtx.Err()
+		case <-time.After(RUNLOCK_POLL):
+		}
+	}
+
+}
+
+// logCommand shows a command about to be run, its passwords redacted,
+// when debugging or for a -dryrun
+func logCommand(name string, args []string) {
+
+	level := slog.LevelDebug
+	if *dryrun {
+		level = slog.LevelInfo
+	}
+	slog.Log(context.Background(), level, "Running", "exec", name, "args", strings.Join(redactArgs(args), " "))
+
+}
+
+// logQueryError reports a failed query whatever the log level, the
+// caller carries on with its default
+func logQueryError(err error, xsql string) {
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		logQueryTimeout(err, xsql)
+		return
+	}
+	slog.Error("Query failed", "sql", xsql, "err", err)
+
+}
+
+// logQueryTimeout reports a query abandoned after MySQL.QueryTimeout
+func logQueryTimeout(err error, xsql string) {
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("Query timed out", "sql", xsql)
+	}
+
+}
+
+// makeCoverPage renders the cover template for this plan and returns
+// the path of the resulting PDF, named after the document it will front
+func makeCoverPage(plandata map[string]string, docname string) (string, error) {
+
+	input := strings.Replace(docname, ".pdf", filepath.Ext(CFG.Pdftk.CoverTemplate), 1)
+	if input == docname {
+		input += ".txt"
+	}
+	output := strings.Replace(docname, ".pdf", "-page.pdf", 1)
+	if *dryrun {
+		slog.Info("DRYRUN: cover page not made", "Filename", output, "template", CFG.Pdftk.CoverTemplate)
+		return output, nil
+	}
+	var sb strings.Builder
+	if err := coverTemplate.Execute(&sb, planFields(plandata)); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(input, []byte(sb.String()), 0644); err != nil {
+		return "", err
+	}
+	defer os.Remove(input)
+
+	argspec := CFG.Pdftk.CoverArgs
+	if argspec == "" {
+		argspec = "#Input# #Output#"
+	}
+	args := strings.Split(argspec, " ")
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "#Input#", input)
+		args[i] = strings.ReplaceAll(args[i], "#Output#", output)
+	}
+	logCommand(CFG.Pdftk.CoverRenderer, args)
+	if out, err := runner.Run(CFG.Pdftk.CoverRenderer, args...); err != nil {
+		return "", fmt.Errorf("%v failed: %v %v", CFG.Pdftk.CoverRenderer, err, strings.TrimSpace(string(out)))
+	}
+	return output, nil
+
+}
+
+func makeInfoFile(infofile string, planno string) error {
+
+	/*
+	 * This creates a text file in the format required by PDFTK used to hold
+	 * metadata for the generated PDFs. If planno is given, any [[field]]
+	 * tokens in the values are resolved for that plan.
+	 *
+	 */
+
+	title := CFG.Pdftk.Title
+	author := CFG.Pdftk.Author
+	extra := make(map[string]string)
+	for key, val := range CFG.Pdftk.InfoExtra {
+		if val != "" {
+			extra[key] = val
+		}
+	}
+	if planno != "" {
+		var err error
+		if title, err = replaceFields(title, planno); err != nil {
+			return err
+		}
+		if author, err = replaceFields(author, planno); err != nil {
+			return err
+		}
+		for key, val := range extra {
+			if extra[key], err = replaceFields(val, planno); err != nil {
+				return err
+			}
+		}
+	}
+
+	const datefmt = "20060102150405000" // Equivalent to VB.Net string "yyyyMMddhhmmsszzz"
+
+	if *dryrun {
+		slog.Info("DRYRUN: info file not written", "Filename", infofile, "title", title, "author", author)
+		return nil
+	}
+	f, err := os.Create(infofile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	info := func(key string, value string) {
+		w.WriteString("InfoBegin\n")
+		w.WriteString("InfoKey: " + infoEscape(key) + "\n")
+		w.WriteString("InfoValue: " + infoEscape(value) + "\n")
+	}
+	info("Title", title)
+	info("Author", author)
+	info("Producer", ProgramVersion)
+	t := time.Now()
+	info("CreationDate", "D'"+t.Format(datefmt)+"'")
+	info("ModDate", "D'"+t.Format(datefmt)+"'")
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		info(key, extra[key])
+	}
+	// An empty value makes pdftk drop the key
+	for _, key := range CFG.Pdftk.StripInfoKeys {
+		info(key, "")
+	}
+	return w.Flush()
+
+}
+
+func makeSecurePDFs() error {
+
+	slog.Info("Making secure PDFs")
+
+	sharedInfo := filepath.Join(workFolder(), CFG.Pdftk.Infofile)
+	infoPerFile := CFG.Pdftk.InfoPerFile || CFG.Pdftk.InfoFromPlan
+	// Document info is left alone if there's no info file (qpdf)
+	if CFG.Pdftk.Infofile != "" && !infoPerFile {
+		if err := makeInfoFile(sharedInfo, ""); err != nil {
+			return err
+		}
+	}
+
+	folder, err := outputFolder()
+	if err != nil {
+		return err
+	}
+	x := filepath.Join(folder, CFG.Pdftk.PDFPrefix+"*.pdf")
+	slog.Debug("Scanning", "mask", x)
+	files := listFolder(folder, CFG.Pdftk.Recursive)
+	myfile, err := compileMask(CFG.Pdftk.PDFMask)
+	if err != nil {
+		return fmt.Errorf("Pdftk.PDFMask: %w", err)
+	}
+	rplan, _ := regexp.Compile(`-(\d+)-`)
+	if planNoIsString() {
+		rplan, _ = regexp.Compile(`-(\w+)-`)
+	}
+	type digest struct {
+		plandata map[string]string
+		pdfs     []string
+		plans    []string // Plan each of pdfs is for
+		npages   int
+	}
+	digests := make(map[string]*digest)
+	var digestOrder []string
+	var matched []string
+	for _, file := range files {
+		if !myfile.MatchString(filepath.Base(file)) {
+			continue
+		}
+		if *onePlan != "" {
+			if m := rplan.FindStringSubmatch(filepath.Base(file)); len(m) < 2 || m[1] != *onePlan {
+				continue
+			}
+		}
+		matched = append(matched, file)
+	}
+	slog.Info("Files to secure", "count", len(matched))
+	if CFG.Pdftk.MaxFiles > 0 && len(matched) > CFG.Pdftk.MaxFiles && !*force {
+		msg := fmt.Sprintf("%v files match %v, more than MaxFiles (%v)", len(matched), CFG.Pdftk.PDFMask, CFG.Pdftk.MaxFiles)
+		if !confirm(msg + ". Continue?") {
+			slog.Warn(msg)
+			return errTooManyFiles
+		}
+	}
+
+	nrex := 0
+	var nopassword []string // Plans secured without a user password
+	for _, file := range matched {
+		// Subfolders are preserved when Recursive
+		Filename := filepath.Base(file)
+		dir := filepath.Join(folder, filepath.Dir(file))
+		if runTimedOut() {
+			break
+		}
+		sa := filepath.Join(dir, strings.Replace(Filename, CFG.Pdftk.PDFPrefix, CFG.Pdftk.PDFPrefix3, 1))
+		slog.Debug("Securing", "Filename", Filename)
+		PlanNo := rplan.FindStringSubmatch(Filename)
+		if len(PlanNo) < 2 || PlanNo[1] == "" {
+			recordError("secure", "", fmt.Sprintf("Cannot process file %v. No Plan number", Filename))
+			continue
+		}
+		PlanData := getPlanData(PlanNo[1])
+		if PlanData == nil {
+			recordError("secure", PlanNo[1], fmt.Sprintf("Cannot process file %v. No details found for plan %v", Filename, PlanNo[1]))
+			continue
+		}
+
+		tmp := filepath.Join(dir, Filename)
+		terms := CFG.Email.Terms[PlanData[PD_PRODUCT]]
+		action, template := statusAction(PlanData[PD_STATUS])
+		switch action {
+		case STATUS_SKIP:
+			if err := skipDocument(tmp, folder); err != nil {
+				recordError("secure", PlanNo[1], fmt.Sprintf("Cannot move %v to %v, %v", Filename, SKIPPED_FOLDER, err))
+				continue
+			}
+			slog.Info("Skipped, moved to "+SKIPPED_FOLDER, "PlanNo", PlanNo[1], "Filename", Filename, "status", PlanData[PD_STATUS])
+			continue
+		case STATUS_REVIEW:
+			routeToReview(tmp, PlanNo[1], fmt.Sprintf("status %v", PlanData[PD_STATUS]))
+			continue
+		case STATUS_TEMPLATE:
+			terms = CFG.Email.Terms[template]
+		}
+
+		// Counted before securing, while the original can still be read
+		npages := 0
+		if wantPageCount() {
+			npages, err = pdfPageCount(tmp, "")
+			if err != nil {
+				recordError("secure", PlanNo[1], fmt.Sprintf("Cannot count the pages of %v, %v", Filename, err))
+				continue
+			}
+		}
+
+		var userpw string
+		if !*force && alreadySecured(tmp, sa) {
+			// An earlier run secured it but stopped before emailing it and
+			// removing the original, so carry on from there
+			slog.Info("Already secured, resuming", "PlanNo", PlanNo[1], "Filename", Filename, "secured", sa)
+		} else {
+			password := planPassword(CFG.Pdftk.PasswordField, PlanData, PlanNo[1])
+			if password == "" && CFG.Pdftk.PasswordFallback != "" {
+				password = planPassword(CFG.Pdftk.PasswordFallback, PlanData, PlanNo[1])
+			}
+			if password == "" && !CFG.Pdftk.NoUserPassword {
+				nopassword = append(nopassword, PlanNo[1])
+			}
+			if CFG.Pdftk.MinPasswordLength > 0 && len(password) < CFG.Pdftk.MinPasswordLength && !CFG.Pdftk.NoUserPassword {
+				switch CFG.Pdftk.ShortPasswordAction {
+				case SHORTPW_PAD:
+					for len(password) < CFG.Pdftk.MinPasswordLength {
+						password += PlanNo[1]
+					}
+				case SHORTPW_RANDOM:
+					password, err = randomPassword(CFG.Pdftk.MinPasswordLength)
+					if err == nil {
+						err = saveRandomPassword(PlanNo[1], password)
+					}
+					if err != nil {
+						recordError("secure", PlanNo[1], fmt.Sprintf("Cannot secure %v, %v", Filename, err))
+						continue
+					}
+				default:
+					routeToReview(tmp, PlanNo[1], "password too short")
+					continue
+				}
+				slog.Info("Password too short", "PlanNo", PlanNo[1], "action", CFG.Pdftk.ShortPasswordAction)
+			}
+			userpw, err = securePDF(tmp, sa, PlanNo[1], PlanData, terms, password)
+			if err != nil {
+				// The original is left to be tried again next time
+				recordError("secure", PlanNo[1], fmt.Sprintf("Cannot secure %v, %v", Filename, err))
+				continue
+			}
+		}
+		nrex++
+		removeFile(tmp)
+		if CFG.Pdftk.VerifyPassword && userpw != "" && !*dryrun {
+			if err := checkPassword(sa, userpw); err != nil {
+				routeToReview(sa, PlanNo[1], "password check failed: "+err.Error())
+				continue
+			}
+		}
+		if strings.HasSuffix(Filename, PORTAL_SUFFIX+".pdf") {
+			if storeSecured(sa, PlanNo[1]) {
+				slog.Info("Delivered by portal, stored but not emailed", "PlanNo", PlanNo[1], "Filename", sa)
+			}
+			continue
+		}
+		if slices.Contains(CFG.Email.NoEmailStatuses, PlanData[PD_STATUS]) {
+			storeSecured(sa, PlanNo[1])
+			slog.Info("Produced but not emailed", "PlanNo", PlanNo[1], "Filename", sa, "status", PlanData[PD_STATUS])
+			continue
+		}
+		slog.Debug("Emailing", "PlanNo", PlanNo[1], "status", PlanData[PD_STATUS])
+		if PlanData[PD_EMAIL] == "" || PlanData[PD_EMAIL] == CFG.Email.BadEmailDefault {
+			switch noEmailAction(PlanData[PD_PRODUCT]) {
+			case NOEMAIL_SKIP:
+				storeSecured(sa, PlanNo[1])
+				slog.Info("No email address, not emailed", "PlanNo", PlanNo[1], "Filename", sa)
+				continue
+			case NOEMAIL_REVIEW:
+				routeToReview(sa, PlanNo[1], "no email address")
+				continue
+			}
+		}
+		if !storeSecured(sa, PlanNo[1]) {
+			continue
+		}
+		if CFG.Email.GroupByAddress || slices.Contains(CFG.Email.DigestProducts, PlanData[PD_PRODUCT]) {
+			dg, ok := digests[PlanData[PD_EMAIL]]
+			if !ok {
+				dg = &digest{plandata: PlanData}
+				digests[PlanData[PD_EMAIL]] = dg
+				digestOrder = append(digestOrder, PlanData[PD_EMAIL])
+			}
+			dg.pdfs = append(dg.pdfs, sa)
+			dg.plans = append(dg.plans, PlanNo[1])
+			dg.npages += npages
+			continue
+		}
+		if err := emailSecurePDF(sa, nil, PlanData, npages); err != nil {
+			return fmt.Errorf("emailing plan %v: %w", PlanNo[1], err)
+		}
+	}
+
+	// One email per address for grouped documents, personalised using the
+	// details of the first plan found for that address
+	for _, addr := range digestOrder {
+		dg := digests[addr]
+		if err := emailSecurePDF(strings.Join(dg.pdfs, ATTACHMENT_SEPARATOR), dg.plans, dg.plandata, dg.npages); err != nil {
+			return fmt.Errorf("emailing %v: %w", addr, err)
+		}
+	}
+	if !CFG.Pdftk.S3.KeepLocal {
+		for local := range storedAs {
+			removeFile(local)
+		}
+	}
+	stats.Secured += nrex
+	if len(nopassword) > 0 {
+		slog.Warn("No password available", "PlanNo", strings.Join(nopassword, ","), "field", strings.TrimSuffix(CFG.Pdftk.PasswordField+" or "+CFG.Pdftk.PasswordFallback, " or "))
+	}
+	slog.Info("PDFs secured", "count", nrex)
+	return nil
+
+}
+
+// makeSpool concatenates the documents generated for a stream into a
+// single print file plus a manifest of page ranges
+func makeSpool(whichq STREAM, folder string, docs [][3]string) {
+
+	base := filepath.Join(folder, whichq.Name+"-"+runID)
+	spool := base + ".pdf"
+	manifest := base + ".csv"
+	separator := ""
+	seppages := 0
+	if whichq.SpoolSeparator != "" {
+		separator = filepath.Join(CFG.Pdftk.Folder, whichq.SpoolSeparator)
+		np, err := pdfPageCount(separator, "")
+		if err != nil {
+			recordError("spool", "", fmt.Sprintf("Cannot spool %v, %v", spool, err))
+			return
+		}
+		seppages = np
+	}
+
+	f, err := os.Create(manifest)
+	if err != nil {
+		recordError("spool", "", fmt.Sprintf("Cannot spool %v, %v", spool, err))
+		return
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"PlanNo", "Ltrid", "FirstPage", "LastPage", "File"})
+
+	var args []string
+	page := 1
+	for i, doc := range docs {
+		if i > 0 && separator != "" {
+			args = append(args, separator)
+			page += seppages
+		}
+		np, err := pdfPageCount(doc[2], "")
+		if err != nil {
+			recordError("spool", doc[0], fmt.Sprintf("Cannot spool %v, %v", spool, err))
+			return
+		}
+		w.Write([]string{doc[0], doc[1], strconv.Itoa(page), strconv.Itoa(page + np - 1), filepath.Base(doc[2])})
+		args = append(args, doc[2])
+		page += np
+	}
+	w.Flush()
+	args = append(args, "cat", "output", spool)
+	if err := runPdftk(args); err != nil {
+		recordError("spool", "", fmt.Sprintf("Cannot spool %v, %v", spool, err))
+		return
+	}
+	slog.Info("Documents spooled", "count", len(docs), "Filename", spool)
+
+}
+
+func maskModeName() string {
+
+	res := "regex"
+	if strings.EqualFold(CFG.Pdftk.MaskMode, "glob") {
+		res = "glob"
+	}
+	if CFG.Pdftk.MaskCaseInsensitive {
+		res += ", ignoring case"
+	}
+	return res
+
+}
+
+// mimeBody encodes message text as quoted-printable, which also keeps
+// every line within the SMTP limit
+func mimeBody(txt string) string {
+
+	var sb strings.Builder
+	w := quotedprintable.NewWriter(&sb)
+	w.Write([]byte(txt))
+	w.Close()
+	return sb.String()
+
+}
+
+// mimeHeader formats a complete header line, using RFC 2047 encoded-words
+// for non-ASCII values and folding it to fit the recommended line length
+func mimeHeader(name string, value string) string {
+
+	const maxline = 76
+
+	enc := mime.BEncoding
+	if strings.EqualFold(CFG.Email.HeaderEncoding, "Q") {
+		enc = mime.QEncoding
+	}
+
+	var sb strings.Builder
+	sb.WriteString(name + ":")
+	linelen := sb.Len()
+	for _, word := range strings.Fields(enc.Encode("utf-8", value)) {
+		// Folding straight after the colon if need be, as encoded words
+		// can be as long as the line
+		if linelen+1+len(word) > maxline {
+			sb.WriteString("\r\n")
+			linelen = 0
+		}
+		sb.WriteString(" " + word)
+		linelen += 1 + len(word)
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+
+}
+
+// missingColumns lists which of planDataColumns plandata doesn't have
+func missingColumns(plandata map[string]string) []string {
+
+	var res []string
+	for _, col := range planDataColumns {
+		if _, ok := plandata[col]; !ok {
+			res = append(res, col)
+		}
+	}
+	return res
+}
+
+// mysqlDSN is the connection string for the mysql driver
+func mysqlDSN() string {
+
+	connectStr := CFG.MySQL.Userid + ":" + CFG.MySQL.Password + "@tcp(" + CFG.MySQL.Server + ")/" + CFG.MySQL.Database
+	//connectStr += "?allowCleartextPasswords=true"
+	charset := CFG.MySQL.Charset
+	if charset == "" {
+		charset = "utf8mb4"
+	}
+	connectStr += "?charset=" + url.QueryEscape(charset)
+	return connectStr
+
+}
+
+// newS3Store checks the S3 settings and picks up the credentials
+func newS3Store(cfg S3) (*s3Store, error) {
+
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("Region must be set")
+	}
+	if cfg.AccessKeyEnv == "" {
+		cfg.AccessKeyEnv = "AWS_ACCESS_KEY_ID"
+	}
+	if cfg.SecretKeyEnv == "" {
+		cfg.SecretKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	s := &s3Store{cfg: cfg, accessKey: os.Getenv(cfg.AccessKeyEnv), secretKey: os.Getenv(cfg.SecretKeyEnv)}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("%v and %v must be set", cfg.AccessKeyEnv, cfg.SecretKeyEnv)
+	}
+	return s, nil
+
+}
+
+// noEmailAction returns the configured action for a product's plans
+// with no email address
+func noEmailAction(product string) string {
+
+	if action, ok := CFG.Email.NoEmailAction[product]; ok {
+		return action
+	}
+	if action, ok := CFG.Email.NoEmailAction["*"]; ok {
+		return action
+	}
+	return NOEMAIL_DEFAULT
+
+}
+
+// normaliseField tidies up a letter field value as configured
+func normaliseField(val string, ops []string) string {
+
+	res := val
+	for _, op := range ops {
+		switch strings.ToLower(op) {
+		case "trim":
+			res = strings.TrimSpace(res)
+		case "collapse":
+			res = strings.Join(strings.Fields(res), " ")
+		case "upper":
+			res = strings.ToUpper(res)
+		case "lower":
+			res = strings.ToLower(res)
+		case "title":
+			words := strings.Fields(strings.ToLower(res))
+			for i, w := range words {
+				r := []rune(w)
+				r[0] = unicode.ToUpper(r[0])
+				words[i] = string(r)
+			}
+			res = strings.Join(words, " ")
+		default:
+			slog.Debug("Unknown field normalisation", "op", op)
+		}
+	}
+	return res
+
+}
+
+// normaliseLineEndings converts any mix of \r\n, \r and \n in txt to a
+// single style, lf or crlf. Anything else leaves txt alone.
+func normaliseLineEndings(txt string, eol string) string {
+
+	var nl string
+	switch strings.ToLower(eol) {
+	case "lf":
+		nl = "\n"
+	case "crlf":
+		nl = "\r\n"
+	default:
+		return txt
+	}
+	txt = strings.ReplaceAll(txt, "\r\n", "\n")
+	txt = strings.ReplaceAll(txt, "\r", "\n")
+	if nl != "\n" {
+		txt = strings.ReplaceAll(txt, "\n", nl)
+	}
+	return txt
+
+}
+
+// normaliseStreams moves the original letter and DD streams to the front
+// of Crninja.Streams, which is all that's looked at from then on, and
+// names any stream that hasn't been
+func normaliseStreams() {
+
+	res := streamList(CFG.Crninja.Crletters, "letters", CFG.Crninja.Letters)
+	for _, whichq := range streamList(CFG.Crninja.Crdouble, "dds", CFG.Crninja.Doubles) {
+		whichq.FormatPage2 = true
+		if whichq.Page2 == (DDS{}) {
+			whichq.Page2 = CFG.DDs
+		}
+		res = append(res, whichq)
+	}
+	for i, whichq := range CFG.Crninja.Streams {
+		if whichq.Name == "" {
+			whichq.Name = "stream" + strconv.Itoa(i+1)
+		}
+		res = append(res, whichq)
+	}
+	CFG.Crninja.Streams = res
+	CFG.Crninja.Crletters, CFG.Crninja.Crdouble = STREAM{}, STREAM{}
+	CFG.Crninja.Letters, CFG.Crninja.Doubles = nil, nil
+
+}
+
+// notifyOperators emails a summary of the run to Email.NotifyAddress,
+// stopped saying why if it ended early
+func notifyOperators(stopped string) {
+
+	if CFG.Email.NotifyAddress == "" {
+		return
+	}
+
+	var sb strings.Builder
+	subject := "PDFWrap run " + runID
+	if nerrors > 0 || stopped != "" {
+		subject += " - PROBLEMS"
+		if stopped != "" {
+			sb.WriteString(stopped + "\n")
+		}
+		fmt.Fprintf(&sb, "%v records skipped:\n", nerrors)
+		for _, msg := range errorMsgs {
+			sb.WriteString("  " + msg + "\n")
+		}
+		sb.WriteString("\n")
+	} else {
+		subject += " - OK"
+	}
+	fmt.Fprintf(&sb, "Run id:         %v\n", runID)
+	fmt.Fprintf(&sb, "PDFs generated: %v\n", stats.Generated)
+	fmt.Fprintf(&sb, "PDFs secured:   %v\n", stats.Secured)
+	fmt.Fprintf(&sb, "Emails queued:  %v\n", stats.Emailed)
+	fmt.Fprintf(&sb, "Reports run:    %v, %v failed\n", stats.Reports+stats.ReportsFailed, stats.ReportsFailed)
+
+	var attachments []string
+	if errorFile != nil {
+		attachments = append(attachments, *errorPath)
+	}
+	if *dryrun {
+		slog.Info("DRYRUN: run summary not sent", "to", CFG.Email.NotifyAddress)
+		return
+	}
+	err := sendMail([]string{CFG.Email.NotifyAddress}, nil, subject, sb.String(), attachments)
+	if err != nil {
+		slog.Error("Failed to send run summary", "to", CFG.Email.NotifyAddress, "err", err)
+	}
+
+}
+
+// outputFolder returns the folder documents are written to and secured
+// in, which is today's subfolder if DateFolders is set
+func outputFolder() (string, error) {
+
+	folder := outputFolderName()
+	if CFG.Pdftk.DateFolders && !*dryrun {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			return "", err
+		}
+	}
+	return folder, nil
+
+}
+
+// outputFolderName is outputFolder without creating anything
+func outputFolderName() string {
+
+	if sandboxed {
+		return sandboxFolder
+	}
+	if !CFG.Pdftk.DateFolders {
+		return CFG.Pdftk.Folder
+	}
+	layout := CFG.Pdftk.DateFolderLayout
+	if layout == "" {
+		layout = "2006/01/02"
+	}
+	return filepath.Join(CFG.Pdftk.Folder, filepath.FromSlash(runStart.Format(layout)))
+
+}
+
+func paperFolder() string {
+
+	folder := CFG.Pdftk.PaperFolder
+	if folder != "" && !filepath.IsAbs(folder) {
+		folder = filepath.Join(workFolder(), folder)
+	}
+	return folder
+
+}
+
+// pdfArgs translates pdftk style args for Pdftk.Tool
+func pdfArgs(args []string) ([]string, error) {
+
+	if CFG.Pdftk.Tool == TOOL_QPDF {
+		return qpdfArgs(args)
+	}
+	return args, nil
+
+}
+
+func pdfPageCount(pdf string, password string) (int, error) {
+
+	if _, err := os.Stat(pdf); err != nil && *dryrun {
+		return 0, nil // Never made
+	}
+	args := []string{pdf}
+	if password != "" {
+		args = append(args, "input_pw", password)
+	}
+	args = append(args, "dump_data")
+	args, err := pdfArgs(args)
+	if err != nil {
+		return 0, err
+	}
+	logCommand(CFG.Pdftk.Exec, args)
+	out, err := runner.Run(CFG.Pdftk.Exec, args...)
+	if err != nil {
+		return 0, fmt.Errorf("counting pages of %v: %v", pdf, err)
+	}
+	rpages := pdftkPages
+	if CFG.Pdftk.Tool == TOOL_QPDF {
+		rpages = qpdfPages
+	}
+	np := rpages.FindSubmatch(out)
+	if len(np) < 2 {
+		return 0, fmt.Errorf("no page count in %v output", CFG.Pdftk.Exec)
+	}
+	res, _ := strconv.Atoi(string(np[1]))
+	return res, nil
+
+}
+
+// planDataNames maps the columns returned by Email.PlanDataSQL to the
+// names used in plan data, ignoring case as some databases fold it. Ten
+// unrecognised columns are taken to be planDataColumns in order.
+func planDataNames(cols []string) []string {
+
+	known := append(slices.Clone(planDataColumns), CFG.Email.ExtraPlanColumns...)
+	names := make([]string, len(cols))
+	found := 0
+	for i, col := range cols {
+		names[i] = col
+		for _, name := range known {
+			if strings.EqualFold(col, name) {
+				names[i] = name
+				found++
+				break
+			}
+		}
+	}
+	if found == 0 && len(cols) == len(planDataColumns) {
+		return planDataColumns
+	}
+	return names
+}
+
+func planDataSource() string {
+
+	if CFG.Email.PlanDataSQL != "" {
+		return "Email.PlanDataSQL"
+	}
+	return "tcustomers"
+
+}
+
+// planFieldColumn returns the plan detail an Email.PlanFields label
+// stands for, otherwise field itself
+func planFieldColumn(field string) string {
+
+	for i, label := range CFG.Email.PlanFields {
+		if strings.EqualFold(label, field) && i < len(planDataColumns) {
+			return planDataColumns[i]
+		}
+	}
+	return field
+
+}
+
+// planFields returns what's available to the email and cover templates
+// for a plan: DearSir and every column of its plan data by name
+func planFields(plandata map[string]string) map[string]string {
+
+	DearSir := plandata[PD_TITLE]
+	if DearSir == "" && plandata[PD_FIRSTNAME] != "" {
+		r, _ := utf8.DecodeRuneInString(plandata[PD_FIRSTNAME])
+		DearSir = string(r) // First initial
+	}
+	if DearSir == "" {
+		// Neither title nor first name so there's nothing to put before
+		// the surname
+		DearSir = CFG.Email.GenericSalutation
+		if DearSir == "" {
+			DearSir = plandata[PD_LASTNAME]
+		}
+		if DearSir == "" {
+			DearSir = DEFAULT_SALUTATION
+		}
+	} else {
+		DearSir = strings.TrimSpace(DearSir + " " + plandata[PD_LASTNAME])
+	}
+	res := map[string]string{"DearSir": DearSir}
+	for name, val := range plandata {
+		res[name] = val
+	}
+	for i, label := range CFG.Email.PlanFields {
+		if label != "" && i < len(planDataColumns) {
+			res[label] = plandata[planDataColumns[i]]
+		}
+	}
+	return res
+
+}
+
+func planNoIsString() bool {
+
+	return strings.EqualFold(CFG.MySQL.PlanNoType, "string")
+}
+
+// planPassword is the plan's value for a Pdftk.PasswordField, without
+// spaces. Fields not in the plan data are read from tcustomers.
+func planPassword(field string, plandata map[string]string, planno string) string {
+
+	col, ok := passwordFields[strings.ToLower(field)]
+	if !ok {
+		col = planFieldColumn(field)
+	}
+	val, ok := plandata[col]
+	if !ok {
+		val = getStringFromDB("SELECT COALESCE("+col+",'') FROM tcustomers WHERE PlanNo=?", "", planno)
+	}
+	return strings.ReplaceAll(val, " ", "")
+
+}
+
+// planTemplate parses an email body or cover page template, first
+// turning the original #DearSir#, #PageCount# and #PlanField# tokens into
+// the equivalent actions
+func planTemplate(name string, txt string) (*template.Template, error) {
+
+	tokens := append([]string{"DearSir", "PageCount"}, planDataColumns...)
+	tokens = append(tokens, CFG.Email.ExtraPlanColumns...)
+	for _, token := range append(tokens, CFG.Email.PlanFields...) {
+		if token != "" {
+			txt = strings.ReplaceAll(txt, "#"+token+"#", `{{index . "`+token+`"}}`)
+		}
+	}
+	funcs := template.FuncMap{"upper": strings.ToUpper, "lower": strings.ToLower, "trim": strings.TrimSpace}
+	return template.New(name).Option("missingkey=zero").Funcs(funcs).Parse(txt)
+
+}
+
+// postgresDSN is the connection URL for the postgres driver
+func postgresDSN() string {
+
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(CFG.MySQL.Userid, CFG.MySQL.Password),
+		Host:   CFG.MySQL.Server,
+		Path:   "/" + CFG.MySQL.Database,
+	}
+	q := url.Values{}
+	if CFG.MySQL.Charset != "" {
+		q.Set("client_encoding", CFG.MySQL.Charset)
+	}
+	if CFG.MySQL.SSLMode != "" {
+		q.Set("sslmode", CFG.MySQL.SSLMode)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+
+}
+
+// prefetchFields fetches the values of the fields used in txt for many
+// plans at once, rather than one query per field per plan. Fields whose
+// SQL can't simply be given an IN clause are left to replaceFields.
+func prefetchFields(txt string, plans []string) {
+
+	const chunksize = 500
+
+	if len(plans) == 0 {
+		return
+	}
+	rfldx, _ := regexp.Compile(`\[\[(\w+)\]\]`)
+	for _, m := range rfldx.FindAllStringSubmatch(txt, -1) {
+		fld := m[1]
+		if _, done := fieldCache[fld]; done {
+			continue
+		}
+		def, err := letterField(fld)
+		if err != nil {
+			return // replaceFields will report it
+		}
+		fieldSQL, fieldType := def.SQL, def.Type
+		if fieldSQL == "" || !batchableFieldSQL(fieldSQL) {
+			continue
+		}
+
+		vals := make(map[string]string)
+		for i := 0; i < len(plans) && vals != nil; i += chunksize {
+			var in []string
+			for _, plan := range plans[i:min(i+chunksize, len(plans))] {
+				in = append(in, sqlplanno(plan))
+			}
+			xsql := "SELECT PlanNo," + fieldSQL + "  WHERE PlanNo IN (" + strings.Join(in, ",") + ")"
+			slog.Debug("Query", "sql", xsql)
+			dbAcquire()
+			ctx, cancel := dbContext()
+			rows, err := DB.QueryContext(ctx, xsql)
+			if err != nil {
+				slog.Debug("Prefetch failed, fetching per plan", "field", fld, "err", err)
+				vals = nil
+				cancel()
+				dbRelease()
+				break
+			}
+			for rows.Next() {
+				var plan string
+				var val sql.NullString
+				rows.Scan(&plan, &val)
+				if !val.Valid && fieldType == FIELD_VALUE_TYPE_DATE {
+					val.String = DEFAULT_NULL_DATE // As replaceFields would have it
+				}
+				if _, seen := vals[plan]; !seen {
+					vals[plan] = fieldValue(fld, fieldType, val.String)
+				}
+			}
+			rows.Close()
+			cancel()
+			dbRelease()
+		}
+		if vals != nil {
+			fieldCache[fld] = vals
+		}
+	}
+
+}
+
+// processStreams formats and generates each stream wanted by this run
+func processStreams() error {
+
+	formatted := make(map[string]bool) // Table and letter already formatted
+	for _, whichq := range CFG.Crninja.Streams {
+		if !wantStream(whichq) {
+			continue
+		}
+		slog.Info("Processing", "stream", whichq.Name)
+		key := whichq.Table + "/" + whichq.Page2.Page2Ltr
+		if whichq.FormatPage2 && !formatted[key] && (wantStage("dd-format") || wantStage("dds")) {
+			// Formatting only touches records still flagged edited=0 so
+			// it's safe to rerun on its own if generation failed last time
+			if err := formatDDPage2s(whichq); err != nil {
+				return fmt.Errorf("formatting %v: %w", whichq.Name, err)
+			}
+			formatted[key] = true
+		}
+		if !wantStage(streamStage(whichq)) {
+			continue
+		}
+		if err := generatePDFs(whichq); err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// Put uploads the document using a path style PUT signed with AWS
+// Signature Version 4. The key is the document's path below the output
+// folder so DateFolders are kept.
+func (s *s3Store) Put(local string) (string, error) {
+
+	data, err := os.ReadFile(local)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(outputFolderName(), local)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(local)
+	}
+	key := s.cfg.Prefix + filepath.ToSlash(rel)
+
+	uri := "/" + s3Escape(s.cfg.Bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequestWithContext(runCtx, http.MethodPut, strings.TrimSuffix(s.cfg.Endpoint, "/")+uri, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	amzdate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+	payload := sha256.Sum256(data)
+	req.Header.Set("Content-Type", "application/pdf")
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	req.Header.Set("X-Amz-Date", amzdate)
+
+	signed := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		http.MethodPut,
+		uri,
+		"",
+		"content-type:application/pdf",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + hex.EncodeToString(payload[:]),
+		"x-amz-date:" + amzdate,
+		"",
+		signed,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	creq := sha256.Sum256([]byte(canonical))
+	tosign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(creq[:])
+
+	sign := func(key []byte, msg string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(msg))
+		return mac.Sum(nil)
+	}
+	k := sign([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	k = sign(k, s.cfg.Region)
+	k = sign(k, "s3")
+	k = sign(k, "aws4_request")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+hex.EncodeToString(sign(k, tosign)))
+
+	slog.Debug("S3 PUT", "url", req.URL)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("upload of %v failed: %v %v", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return "s3://" + s.cfg.Bucket + "/" + key, nil
+
+}
+
+// qpdfArgs translates pdftk args, as used throughout, into the
+// equivalent for qpdf. Anything qpdf can't do is an error rather than
+// being quietly dropped.
+func qpdfArgs(args []string) ([]string, error) {
+
+	var inputs, handles []string
+	var op, opfile, output, inputpw, ownerpw, userpw string
+	var ranges, extra, allow []string
+	isPermission := func(arg string) bool {
+		for _, keyword := range allowKeywords {
+			if arg == keyword {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		next := func() string {
+			i++
+			if i < len(args) {
+				return args[i]
+			}
+			return ""
+		}
+		switch {
+		case arg == "input_pw":
+			inputpw = next()
+		case arg == "output":
+			output = next()
+		case arg == "owner_pw":
+			ownerpw = next()
+		case arg == "user_pw":
+			userpw = next()
+		case arg == "allow":
+			for i+1 < len(args) && isPermission(args[i+1]) {
+				allow = append(allow, next())
+			}
+		case op == "" && slices.Contains([]string{"background", "stamp", "multistamp", "update_info"}, arg):
+			op = arg
+			opfile = next()
+		case op == "" && (arg == "cat" || arg == "dump_data"):
+			op = arg
+		case op == "cat" && output == "":
+			ranges = append(ranges, arg)
+		case op == "" && output == "":
+			handle, file, ok := strings.Cut(arg, "=")
+			if !ok || handle == "" || strings.ToUpper(handle) != handle {
+				handle, file = "", arg
+			}
+			handles = append(handles, handle)
+			inputs = append(inputs, file)
+		default:
+			extra = append(extra, arg)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no input for qpdf in %v", strings.Join(args, " "))
+	}
+
+	var res []string
+	if inputpw != "" {
+		res = append(res, "--password="+inputpw)
+	}
+	switch op {
+	case "dump_data":
+		return append(res, "--show-npages", inputs[0]), nil
+	case "cat":
+		res = append(res, "--empty", "--pages")
+		if len(ranges) == 0 {
+			for _, input := range inputs {
+				res = append(res, input, "1-z")
+			}
+		}
+		for _, r := range ranges {
+			// A page range optionally prefixed by an input's handle
+			hi := 0
+			if h := strings.TrimRight(r, "0123456789-end"); h != "" {
+				hi = slices.Index(handles, h)
+				if hi < 0 {
+					return nil, fmt.Errorf("unknown handle %v in %v", h, strings.Join(args, " "))
+				}
+				r = strings.TrimPrefix(r, h)
+			}
+			if r == "" {
+				r = "1-z"
+			}
+			res = append(res, inputs[hi], strings.ReplaceAll(r, "end", "z"))
+		}
+		res = append(res, "--")
+	case "background":
+		res = append(res, inputs[0], "--underlay", opfile, "--from=", "--repeat=1", "--")
+	case "stamp":
+		res = append(res, inputs[0], "--overlay", opfile, "--from=", "--repeat=1", "--")
+	case "multistamp":
+		res = append(res, inputs[0], "--overlay", opfile, "--")
+	case "":
+		if len(inputs) > 1 {
+			return nil, fmt.Errorf("qpdf needs cat to combine %v", strings.Join(inputs, " "))
+		}
+		res = append(res, inputs[0])
+	default:
+		return nil, fmt.Errorf("%v isn't supported by qpdf", op)
+	}
+	if ownerpw != "" || userpw != "" {
+		if ownerpw == "" {
+			ownerpw = userpw
+		}
+		// pdftk refuses whatever isn't allowed, while qpdf allows
+		// everything unless told otherwise
+		res = append(res, "--encrypt", userpw, ownerpw, "256")
+		yn := func(keyword string) string {
+			if slices.Contains(allow, keyword) {
+				return "y"
+			}
+			return "n"
+		}
+		printing := "none"
+		if slices.Contains(allow, "Printing") {
+			printing = "full"
+		} else if slices.Contains(allow, "DegradedPrinting") {
+			printing = "low"
+		}
+		res = append(res, "--print="+printing, "--extract="+yn("CopyContents"), "--modify-other="+yn("ModifyContents"),
+			"--annotate="+yn("ModifyAnnotations"), "--assemble=n", "--form=n", "--")
+	}
+	if output == "" {
+		return nil, fmt.Errorf("no output for qpdf in %v", strings.Join(args, " "))
+	}
+	res = append(res, extra...)
+	return append(res, output), nil
+
+}
+
+// queryPlanData runs a customer details query, returning the first row
+// keyed by names, or by planDataNames if names is nil. Nil if there's no
+// such plan or the query fails.
+func queryPlanData(xsql string, names []string, args ...any) map[string]string {
+
+	slog.Debug("Query", "sql", xsql, "args", args)
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, rebind(xsql), args...)
+	if err != nil {
+		logQueryError(err, xsql)
+		return nil
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	if names == nil {
+		names = planDataNames(cols)
+	}
+	if len(cols) != len(names) || !rows.Next() {
+		return nil
+	}
+	vals := make([]sql.NullString, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		slog.Debug("Query failed", "sql", xsql, "err", err)
+		return nil
+	}
+	res := make(map[string]string, len(cols))
+	for i, v := range vals {
+		res[names[i]] = v.String
+	}
+	return res
+
+}
+
+// queryRow runs a query expected to return a single row, scanning it
+// into dest. sql.ErrNoRows if there's no row.
+func queryRow(ctx context.Context, q Querier, xsql string, dest ...any) error {
+
+	rows, err := q.QueryContext(ctx, xsql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	return rows.Close()
+
+}
+
+// queuedRecords reads the records of a stream matching the condition
+func queuedRecords(whichq STREAM, where string) ([]queued, error) {
+
+	routed := len(CFG.Crninja.DeliveryMethods) > 0
+	xsql := "SELECT " + whichq.PlanNo + "," + whichq.Ltrid + ",PrintBatch"
+	for _, col := range whichq.Params {
+		xsql += "," + col
+	}
+	if routed {
+		xsql += ",DelMeth"
+	}
+	xsql += " FROM " + whichq.Table
+	xsql += " WHERE " + where
+	slog.Debug("Query", "sql", xsql)
+	var res []queued
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, xsql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var q queued
+		vals := make([]sql.NullString, len(whichq.Params))
+		ptrs := []any{&q.PlanNo, &q.Ltrid, &q.PrintBatch}
+		for i := range vals {
+			ptrs = append(ptrs, &vals[i])
+		}
+		if routed {
+			ptrs = append(ptrs, &q.DelMeth)
+		}
+		rows.Scan(ptrs...)
+		for i, col := range whichq.Params {
+			q.Params = append(q.Params, col+":"+vals[i].String)
+		}
+		res = append(res, q)
+	}
+	return res, rows.Err()
+
+}
+
+// randomPassword returns n characters chosen to avoid lookalikes
+func randomPassword(n int) (string, error) {
+
+	const chars = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz23456789"
+
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		x, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(chars[x.Int64()])
+	}
+	return sb.String(), nil
+
+}
+
+// rebind rewrites ? placeholders as $1, $2 ... for databases that number
+// them, leaving any inside quoted strings alone
+func rebind(xsql string) string {
+
+	if !sqlDialect().Numbered {
+		return xsql
+	}
+	var sb strings.Builder
+	n := 0
+	var quote byte
+	for i := 0; i < len(xsql); i++ {
+		c := xsql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+
+}
+
+// reclaimAbandoned puts back records still marked in Crninja.ClaimColumn
+// by a run which started more than ReclaimAfter ago. Finished runs clear
+// their marks so these were left by one which died part way through.
+func reclaimAbandoned(ctx context.Context, tx DBTx, whichq STREAM) error {
+
+	if CFG.Crninja.ClaimColumn == "" {
+		return nil
+	}
+	after := CFG.Crninja.ReclaimAfter
+	if after <= 0 {
+		after = DEFAULT_RECLAIMAFTER
+	}
+	// Run IDs start with the time the run started so sort by it
+	cutoff := runStart.Add(-after).Format(RUNID_LAYOUT)
+	xsql := "UPDATE " + whichq.Table + " SET PrintBatch=0," + CFG.Crninja.ClaimColumn + "=NULL"
+	xsql += " WHERE " + CFG.Crninja.ClaimColumn + " < '" + cutoff + "'"
+	slog.Debug("Query", "sql", xsql)
+	res, err := tx.ExecContext(ctx, xsql)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("Records abandoned by earlier runs reclaimed", "stream", whichq.Name, "count", n)
+	}
+	return nil
+
+}
+
+// recordError reports a problem with a single record which is then skipped
+func recordError(stage string, planno string, msg string) {
+
+	errorMu.Lock()
+	defer errorMu.Unlock()
+	nerrors++
+	stats.Failures[stage]++ // Also guarded by errorMu
+	errorMsgs = append(errorMsgs, msg)
+	if errorFile != nil {
+		fmt.Fprintf(errorFile, "%v\t%v\t%v\t%v\n", time.Now().Format(time.DateTime), stage, planno, msg)
+	}
+	if errorFile == nil || !*quietErrors {
+		slog.Error(msg, "stage", stage, "PlanNo", planno)
+	}
+
+}
+
+// redactArgs returns a copy of CRNINJA, pdftk or qpdf arguments with the
+// passwords in them replaced by REDACTED, for showing to the operator
+func redactArgs(args []string) []string {
+
+	res := slices.Clone(args)
+	for i := 0; i < len(res); i++ {
+		switch arg := res[i]; {
+		case arg == "-P" || arg == "owner_pw" || arg == "user_pw" || arg == "input_pw":
+			if i+1 < len(res) {
+				i++
+				res[i] = REDACTED
+			}
+		case arg == "--encrypt":
+			// Followed by the user and owner passwords
+			for n := 0; n < 2 && i+1 < len(res); n++ {
+				i++
+				res[i] = REDACTED
+			}
+		case strings.HasPrefix(arg, "-P") && arg != "-P":
+			res[i] = "-P" + REDACTED
+		case strings.HasPrefix(arg, "--password="):
+			res[i] = "--password=" + REDACTED
+		}
+	}
+	return res
+
+}
+
+// releaseClaims gives back the stream's records matching the condition
+// so that the next run picks them up again
+func releaseClaims(whichq STREAM, where string) error {
+
+	xsql := "UPDATE " + whichq.Table + " SET PrintBatch=0"
+	if CFG.Crninja.ClaimColumn != "" {
+		xsql += "," + CFG.Crninja.ClaimColumn + "=NULL"
+	}
+	return runsql(xsql + " WHERE " + where)
+
+}
+
+// removeFile deletes a working or finished document, unless -dryrun
+func removeFile(path string) {
+
+	if *dryrun {
+		slog.Debug("DRYRUN: remove", "path", path)
+		return
+	}
+	os.Remove(path)
+
+}
+
+// renameFile moves a document, unless -dryrun
+func renameFile(from string, to string) error {
+
+	if *dryrun {
+		slog.Debug("DRYRUN: rename", "from", from, "to", to)
+		return nil
+	}
+	return os.Rename(from, to)
+
+}
+
+// replaceFields fills in the [[field]] tokens in txt for planno. Fields
+// without a definition are left as they are.
+func replaceFields(txt string, planno string) (string, error) {
+
+	var res string
+
+	res = txt
+	rfldx, _ := regexp.Compile(`\[\[(\w+)\]\]`)
+	rflds := rfldx.FindAllStringSubmatch(txt, -1)
+	resolved := make(map[string]bool) // Each field is only looked up once per plan
+	for i := 0; i < len(rflds); i++ {
+		fld := rflds[i][1]
+		if resolved[fld] {
+			continue
+		}
+		resolved[fld] = true
+		def, err := letterField(fld)
+		if err != nil {
+			return "", err
+		}
+		fieldSQL, fieldType := def.SQL, def.Type
+		if fieldSQL == "" {
+			continue
+		}
+
+		xsql := "SELECT " + fieldSQL + "  WHERE PlanNo=?"
+		xnew, cached := fieldCache[fld][planno]
+
+		switch {
+		case cached:
+			// Already fetched by prefetchFields
+		case fieldType == FIELD_VALUE_TYPE_CURRENCY:
+			xval := getFloatFromDB(xsql, 0.00, planno)
+			xnew = formatCurrency(xval)
+		case fieldType == FIELD_VALUE_TYPE_DATE:
+			xval := getStringFromDB(xsql, DEFAULT_NULL_DATE, planno)
+			xnew = formatDate(xval, fld)
+		case fieldType == FIELD_VALUE_TYPE_INTEGER:
+			xval := getIntegerFromDB(xsql, 0, planno)
+			xnew = strconv.FormatInt(xval, 10)
+		default:
+			xnew = getStringFromDB(xsql, "", planno)
+		}
+		xnew = normaliseField(xnew, CFG.Email.FieldNormalise[fieldTypeNames[fieldType]])
+		res = strings.ReplaceAll(res, "[["+fld+"]]", xnew)
+
+	}
+
+	return res, nil
+}
+
+// replayEmails requeues the emails audited for an earlier run, for use
+// when the toutgoingemails rows have been lost. Only attachments still
+// on disk are included, and grouped documents go separately to each
+// plan. No PDFs are generated or secured.
+func replayEmails(runid string) error {
+
+	if CFG.MySQL.AuditTable == "" {
+		return errors.New("no AuditTable configured, nothing to replay")
+	}
+	slog.Info("Replaying emails", "from", runid)
+
+	type audited struct {
+		PlanNo string
+		Detail string
+	}
+	var emails []audited
+	xsql := "SELECT PlanNo,Detail FROM " + CFG.MySQL.AuditTable
+	xsql += " WHERE RunID='" + safesql(runid) + "' AND Action='email' ORDER BY LoggedAt"
+	slog.Debug("Query", "sql", xsql)
+	dbAcquire()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, xsql)
+	if err != nil {
+		dbRelease()
+		return err
+	}
+	for rows.Next() {
+		var a audited
+		rows.Scan(&a.PlanNo, &a.Detail)
+		emails = append(emails, a)
+	}
+	rows.Close()
+	dbRelease()
+
+	nemails := 0
+	for _, a := range emails {
+		var pdfs []string
+		for _, pdf := range strings.Split(a.Detail, ATTACHMENT_SEPARATOR) {
+			if _, err := os.Stat(pdf); err == nil || strings.HasPrefix(pdf, "s3://") {
+				pdfs = append(pdfs, pdf)
+			} else {
+				recordError("replay", a.PlanNo, fmt.Sprintf("%v no longer exists", pdf))
+			}
+		}
+		if len(pdfs) == 0 {
+			continue
+		}
+		PlanData := getPlanData(a.PlanNo)
+		if PlanData == nil {
+			recordError("replay", a.PlanNo, fmt.Sprintf("No details found for plan %v", a.PlanNo))
 			continue
 		}
-		nrex++
-		if *debug {
-			fmt.Printf("Securing %v\n", Filename)
+		if err := emailSecurePDF(strings.Join(pdfs, ATTACHMENT_SEPARATOR), nil, PlanData, 0); err != nil {
+			return fmt.Errorf("emailing plan %v: %w", a.PlanNo, err)
+		}
+		nemails++
+	}
+	slog.Info("Emails requeued", "count", nemails, "of", len(emails))
+	return nil
+
+}
+
+// resolveSendingUser works out who to record as the sender of emails
+func resolveSendingUser() string {
+
+	if *operator != "" {
+		return *operator
+	}
+	switch CFG.Email.SendingUser {
+	case "#OSUser#":
+		u, err := user.Current()
+		if err != nil {
+			return os.Getenv("USER")
+		}
+		return u.Username
+	case "#DBUser#":
+		return getStringFromDB(sqlDialect().CurrentUserSQL, CFG.MySQL.Userid)
+	}
+	return CFG.Email.SendingUser
+
+}
+
+// reviewFolder returns the full path of Pdftk.ReviewFolder
+func reviewFolder() string {
+
+	folder := CFG.Pdftk.ReviewFolder
+	if folder != "" && !filepath.IsAbs(folder) {
+		folder = filepath.Join(workFolder(), folder)
+	}
+	return folder
+
+}
+
+// routeToReview parks a document in the review folder for a human to deal with
+func routeToReview(pdf string, planno string, reason string) {
+
+	msg := fmt.Sprintf("Plan %v needs review (%v)", planno, reason)
+	if _, err := os.Stat(pdf); err == nil && CFG.Pdftk.ReviewFolder != "" && !*dryrun {
+		dest := filepath.Join(reviewFolder(), filepath.Base(pdf))
+		err := os.MkdirAll(reviewFolder(), 0755)
+		if err == nil {
+			err = os.Rename(pdf, dest)
+		}
+		if err != nil {
+			msg += ", left in place as it can't be moved to review: " + err.Error()
+		} else {
+			msg += ", moved to " + dest
+		}
+	}
+	recordError("review", planno, msg)
+
+}
+
+// runCrninja runs CrystalReportsNinja to produce a PDF for one batch. A
+// non-empty result describes a failure: the report wouldn't run, its
+// output matched one of the FailPatterns or no PDF was produced.
+func runCrninja(rpt string, output string, batch int64, params []string) string {
+
+	args := []string{"-F", rpt, "-O", output}
+	args = append(args, "-E", "pdf")
+	args = append(args, "-a", "PrintBatch:"+strconv.FormatInt(batch, 10))
+	for _, p := range params {
+		args = append(args, "-a", p)
+	}
+	args = append(args, strings.Split(CFG.Crninja.DBAccess, " ")...)
+
+	logCommand(CFG.Crninja.Exec, args)
+	if *dryrun {
+		return ""
+	}
+	out, err := runner.Run(CFG.Crninja.Exec, args...)
+	problem := ""
+	if err != nil {
+		problem = fmt.Sprintf("failed, %v: %v", err, firstLines(string(out), CRNINJA_OUTPUT_LINES))
+	}
+	for _, rx := range failPatterns {
+		if problem != "" {
+			break
+		}
+		if m := rx.Find(out); m != nil {
+			problem = "reported " + strings.TrimSpace(string(m))
+		}
+	}
+	if problem == "" {
+		fi, err := os.Stat(output)
+		if err != nil || fi.Size() == 0 {
+			problem = "produced no output for " + filepath.Base(output)
+		}
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if problem != "" {
+		stats.ReportsFailed++
+		return "CRNINJA " + rpt + " " + problem
+	}
+	stats.Reports++
+	return ""
+
+}
+
+// runPdftk runs pdftk, retrying as configured in case the failure was
+// transient, eg a locked file
+func runPdftk(args []string) error {
+
+	if CFG.Pdftk.FinalArgs != "" {
+		args = append(args, CFG.Pdftk.FinalArgs)
+	}
+	argx, err := pdfArgs(args)
+	if err != nil {
+		return err
+	}
+	logCommand(CFG.Pdftk.Exec, argx)
+	if *dryrun {
+		return nil
+	}
+	delay := CFG.Pdftk.RetryDelay
+	if delay <= 0 {
+		delay = DEFAULT_RETRYDELAY
+	}
+	for attempt := 0; ; attempt++ {
+		out, err := runner.Run(CFG.Pdftk.Exec, argx...)
+		if err == nil {
+			return nil
+		}
+		if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == QPDF_WARNINGS && CFG.Pdftk.Tool == TOOL_QPDF {
+			return nil
+		}
+		err = fmt.Errorf("%v %v failed: %v %v", CFG.Pdftk.Tool, strings.Join(redactArgs(argx), " "), err, strings.TrimSpace(string(out)))
+		if attempt >= CFG.Pdftk.MaxRetries {
+			return err
+		}
+		slog.Warn("Retrying", "err", err, "delay", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+}
+
+// runSandbox regenerates the most recently printed letter for a plan and
+// takes it through securing and emailing in a temporary folder, showing
+// exactly what the customer would get
+func runSandbox(planno string) bool {
+
+	dir, err := os.MkdirTemp("", "pdfwrap-sandbox")
+	if err != nil {
+		slog.Error("Cannot create sandbox", "err", err)
+		return false
+	}
+	sandboxed = true
+	sandboxFolder = dir
+	CFG.Pdftk.ReviewFolder = filepath.Join(dir, "review")
+	if CFG.Pdftk.PaperFolder != "" {
+		CFG.Pdftk.PaperFolder = filepath.Join(dir, "paper")
+	}
+	CFG.Email.DeleteAfterEmail = false
+	store = localStore{}
+
+	var q queued
+	var whichq STREAM
+	for _, sq := range CFG.Crninja.Streams {
+		recs, err := queuedRecords(sq, sq.PlanNo+"="+sqlplanno(planno)+" AND PrintBatch > 0 ORDER BY PrintBatch DESC LIMIT 1")
+		if err != nil {
+			slog.Error("Cannot read stream", "stream", sq.Name, "err", err)
+			os.RemoveAll(dir)
+			return false
+		}
+		if len(recs) > 0 {
+			q, whichq = recs[0], sq
+			break
+		}
+	}
+	if q.PlanNo == "" {
+		slog.Error("No printed letters to regenerate", "PlanNo", planno)
+		os.RemoveAll(dir)
+		return false
+	}
+	slog.Info("Sandbox", "PlanNo", planno, "Ltrid", q.Ltrid, "stream", whichq.Name, "PrintBatch", q.PrintBatch, "folder", dir)
+
+	if generateDocument(whichq, q, q.PrintBatch, dir) != "" {
+		if err := makeSecurePDFs(); err != nil {
+			slog.Error("Securing failed", "err", err)
+			return false
+		}
+	}
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			slog.Info("Produced", "Filename", path)
+		}
+		return nil
+	})
+	return nerrors == 0
+
+}
+
+func runsql(xsql string) error {
+
+	slog.Debug("Query", "sql", xsql)
+	if sandboxed {
+		return nil
+	}
+	if *dryrun {
+		slog.Info("DRYRUN: not run", "sql", xsql)
+		return nil
+	}
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	if _, err := DB.ExecContext(ctx, xsql); err != nil {
+		logQueryTimeout(err, xsql)
+		return fmt.Errorf("%v: %w", xsql, err)
+	}
+	return nil
+}
+
+// runTimedOut reports whether the -deadline has passed, in which case we
+// finish the current record but don't start any more
+func runTimedOut() bool {
+
+	return runCtx.Err() != nil
+}
+
+// s3Escape URI encodes an object path as Signature Version 4 requires,
+// leaving only unreserved characters and the / separators alone
+func s3Escape(p string) string {
+
+	var sb strings.Builder
+	for _, b := range []byte(p) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9', strings.IndexByte("-._~/", b) >= 0:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+
+}
+
+func safesql(x string) string {
+
+	if sqlDialect().DoubleQuotes {
+		return strings.ReplaceAll(strings.ReplaceAll(x, "\x00", ""), "'", "''")
+	}
+	var sb strings.Builder
+	for i := 0; i < len(x); i++ {
+		c := x[i]
+		switch c {
+		case '\\', 0, '\n', '\r', '\'', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\032':
+			sb.WriteByte('\\')
+			sb.WriteByte('Z')
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// saveRandomPassword records the random password a plan's document is
+// secured with in Pdftk.RandomPasswordColumn
+func saveRandomPassword(planno string, password string) error {
+
+	if CFG.Pdftk.RandomPasswordColumn == "" {
+		return errors.New("random password but no Pdftk.RandomPasswordColumn to save it in")
+	}
+	// Bound rather than going through runsql, which would show the password
+	xsql := "UPDATE tcustomers SET " + CFG.Pdftk.RandomPasswordColumn + "=? WHERE PlanNo=?"
+	slog.Debug("Saving random password", "PlanNo", planno, "sql", xsql)
+	if sandboxed || *dryrun {
+		return nil
+	}
+	dbAcquire()
+	defer dbRelease()
+	ctx, cancel := dbContext()
+	defer cancel()
+	if _, err := DB.ExecContext(ctx, rebind(xsql), password, planno); err != nil {
+		logQueryTimeout(err, xsql)
+		return fmt.Errorf("saving random password: %w", err)
+	}
+	return nil
+
+}
+
+func (t *auditTime) Scan(src any) error {
+
+	switch v := src.(type) {
+	case time.Time:
+		t.Time = v
+	case []byte:
+		return t.Scan(string(v))
+	case string:
+		var err error
+		t.Time, err = time.Parse(time.DateTime, v)
+		return err
+	default:
+		return fmt.Errorf("LoggedAt is %T, not a time", src)
+	}
+	return nil
+
+}
+
+// securePDF makes secured from original by adding any cover page, the
+// terms, stamp and document info, then encrypting it. The intermediate
+// files are always removed, as is secured unless everything worked, so
+// only a complete document can be emailed. original itself is left for
+// the caller. Returns the user password applied, if any.
+func securePDF(original string, secured string, planno string, plandata map[string]string, terms string, password string) (userpw string, err error) {
+
+	dir, name := filepath.Split(original)
+	tm2 := filepath.Join(dir, strings.Replace(name, CFG.Pdftk.PDFPrefix, CFG.Pdftk.PDFPrefix2, 1))
+	src := original
+	infoPerFile := CFG.Pdftk.InfoPerFile || CFG.Pdftk.InfoFromPlan
+	infofile := filepath.Join(workFolder(), CFG.Pdftk.Infofile)
+	if infoPerFile {
+		infofile = strings.Replace(tm2, ".pdf", ".info", 1)
+	}
+	defer func() {
+		removeFile(tm2)
+		if infoPerFile {
+			removeFile(infofile)
+		}
+		if src != original {
+			removeFile(src)
+		}
+		if err != nil {
+			removeFile(secured)
+		}
+	}()
+
+	if CFG.Pdftk.CoverTemplate != "" {
+		src = strings.Replace(original, ".pdf", "-cover.pdf", 1)
+		cover, err := makeCoverPage(plandata, src)
+		if err != nil {
+			return "", err
+		}
+		err = runPdftk([]string{cover, original, "cat", "output", src})
+		removeFile(cover)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := runPdftk([]string{src, terms, "output", tm2}); err != nil {
+		return "", err
+	}
+
+	if CFG.Pdftk.Stamp != "" {
+		stamped := strings.Replace(tm2, ".pdf", "-stamped.pdf", 1)
+		if err := runPdftk([]string{tm2, "multistamp", filepath.Join(CFG.Pdftk.Folder, CFG.Pdftk.Stamp), "output", stamped}); err != nil {
+			removeFile(stamped)
+			return "", err
+		}
+		if err := renameFile(stamped, tm2); err != nil {
+			return "", err
 		}
-		PlanNo := rplan.FindStringSubmatch(Filename)
-		if len(PlanNo) < 2 || PlanNo[1] == "" {
-			if !*silent {
-				fmt.Printf("Cannot process file %v. No Plan number\n", Filename)
+	}
+
+	if infoPerFile {
+		infoplan := ""
+		if CFG.Pdftk.InfoFromPlan {
+			infoplan = planno
+		}
+		if err := makeInfoFile(infofile, infoplan); err != nil {
+			return "", err
+		}
+	}
+	args := []string{tm2}
+	// Document info is left alone if there's no info file (qpdf)
+	if CFG.Pdftk.Infofile != "" || infoPerFile {
+		args = append(args, "update_info", infofile)
+	}
+	args = append(args, "output", secured)
+	if encryptionExempt(plandata[PD_PRODUCT], plandata[PD_POSTCODE]) {
+		slog.Info("Exempt from encryption", "PlanNo", planno, "postcode", plandata[PD_POSTCODE])
+	} else {
+		if CFG.Pdftk.OwnerPass != "" {
+			args = append(args, "owner_pw", CFG.Pdftk.OwnerPass)
+		}
+		if !CFG.Pdftk.NoUserPassword && password != "" {
+			args = append(args, "user_pw", password)
+			userpw = password
+		}
+		if len(CFG.Pdftk.Allow) > 0 {
+			args = append(args, "allow")
+			for _, allow := range CFG.Pdftk.Allow {
+				args = append(args, allowKeywords[strings.ToLower(allow)])
 			}
-			continue
 		}
-		PlanData := strings.Split(getStringFromDB(pdsql+PlanNo[1], ""), DATA_SEPARATOR)
+		if !slices.Contains(args, "owner_pw") && !slices.Contains(args, "user_pw") {
+			return "", errors.New("no password available")
+		}
+	}
+	if err := runPdftk(args); err != nil {
+		return "", err
+	}
+	if *dryrun {
+		return userpw, nil
+	}
+	if fi, err := os.Stat(secured); err != nil {
+		return "", err
+	} else if fi.Size() == 0 {
+		return "", fmt.Errorf("%v is empty", secured)
+	}
+	return userpw, nil
+
+}
+
+// selfTestPdftk encrypts a one page PDF with a known password and checks
+// that it then won't open without it but will open with it
+func selfTestPdftk() error {
+
+	const testpass = "pdfwrap"
+
+	dir, err := os.MkdirTemp("", "pdfwrap")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "plain.pdf")
+	secure := filepath.Join(dir, "secure.pdf")
+	err = os.WriteFile(plain, testPDF(), 0644)
+	if err != nil {
+		return err
+	}
+
+	args := []string{plain, "output", secure, "owner_pw", testpass + "x", "user_pw", testpass}
+	if CFG.Pdftk.FinalArgs != "" {
+		args = append(args, CFG.Pdftk.FinalArgs)
+	}
+	args, err = pdfArgs(args)
+	if err != nil {
+		return err
+	}
+	out, err := runner.Run(CFG.Pdftk.Exec, args...)
+	if err != nil {
+		return fmt.Errorf("encrypting with %v: %v %v", CFG.Pdftk.Exec, err, strings.TrimSpace(string(out)))
+	}
+	return checkPassword(secure, testpass)
+
+}
+
+// sendMail sends a message via the configured SMTP server. bcc addresses
+// get a copy without appearing in the message.
+func sendMail(to []string, bcc []string, subject string, body string, attachments []string) error {
+
+	smtpcfg := CFG.Email.SMTP
+	port := smtpcfg.Port
+	if port == 0 {
+		port = 25
+	}
+	msg, err := buildMessage(to, subject, body, attachments)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Sending", "smtp", net.JoinHostPort(smtpcfg.Host, strconv.Itoa(port)), "subject", subject, "to", strings.Join(to, ","))
+	c, err := smtp.Dial(net.JoinHostPort(smtpcfg.Host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if smtpcfg.StartTLS {
+		if err = c.StartTLS(&tls.Config{ServerName: smtpcfg.Host}); err != nil {
+			return err
+		}
+	}
+	if smtpcfg.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", smtpcfg.Username, smtpcfg.Password, smtpcfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(smtpcfg.From); err != nil {
+		return err
+	}
+	// Bcc addresses are only given to the server, never in the headers
+	for _, addr := range append(to, bcc...) {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+
+}
+
+// setConfig sets the CFG setting at path key, eg Email.TestRecipient,
+// from value as YAML. Text settings take value as it is.
+func setConfig(key string, value string) error {
+
+	v := reflect.ValueOf(&CFG).Elem()
+	path := strings.Split(key, ".")
+	for i, name := range path {
+		switch v.Kind() {
+		case reflect.Struct:
+			f := v.FieldByNameFunc(func(fn string) bool { return strings.EqualFold(fn, name) })
+			if !f.IsValid() {
+				return fmt.Errorf("no setting %v", strings.Join(path[:i+1], "."))
+			}
+			v = f
+		case reflect.Map:
+			if i != len(path)-1 {
+				return fmt.Errorf("%v is a map of simple values", strings.Join(path[:i], "."))
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			elem := reflect.New(v.Type().Elem())
+			if err := yaml.Unmarshal([]byte(value), elem.Interface()); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(name).Convert(v.Type().Key()), elem.Elem())
+			return nil
+		default:
+			return fmt.Errorf("%v has no setting %v", strings.Join(path[:i], "."), name)
+		}
+	}
+	if v.Kind() == reflect.Struct || v.Kind() == reflect.Map {
+		return fmt.Errorf("%v is a section, not a setting", key)
+	}
+
+	if value == "" {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+	nv := reflect.New(v.Type())
+	if err := yaml.Unmarshal([]byte(value), nv.Interface()); err != nil {
+		return err
+	}
+	v.Set(nv.Elem())
+	return nil
 
-		// We're going to use the Plan's main phone number as the encryption key
-		password := strings.ReplaceAll(PlanData[2], " ", "")
-		tmp := filepath.Join(CFG.Pdftk.Folder, Filename)
-		tm2 := filepath.Join(CFG.Pdftk.Folder, strings.Replace(Filename, CFG.Pdftk.PDFPrefix, CFG.Pdftk.PDFPrefix2, 1))
-		sa := filepath.Join(CFG.Pdftk.Folder, strings.Replace(Filename, CFG.Pdftk.PDFPrefix, CFG.Pdftk.PDFPrefix3, 1))
-		args := []string{tmp}
-		args = append(args, CFG.Email.Terms[PlanData[0]])
-		args = append(args, "output", tm2)
-		runPdftk(args)
+}
 
-		args = []string{tm2}
-		args = append(args, "update_info", filepath.Join(CFG.Pdftk.Folder, CFG.Pdftk.Infofile))
-		args = append(args, "output", sa)
-		args = append(args, "owner_pw", CFG.Pdftk.OwnerPass)
-		args = append(args, "user_pw", password)
-		runPdftk(args)
+// setupLogging sends the log to -logfile, or the screen, at the level
+// set by -s (errors only) and -debug
+func setupLogging() error {
 
-		// No longer need .tmp or .tm2
-		os.Remove(filepath.Join(CFG.Pdftk.Folder, file.Name()))
-		os.Remove(filepath.Join(CFG.Pdftk.Folder, strings.Replace(file.Name(), CFG.Pdftk.PDFPrefix, CFG.Pdftk.PDFPrefix2, 1)))
-		emailSecurePDF(sa, PlanData)
+	level := slog.LevelInfo
+	if *silent {
+		level = slog.LevelError
+	}
+	if *debug {
+		level = slog.LevelDebug
 	}
-	if !*silent {
-		fmt.Printf("%v PDFs secured\n", nrex)
+	opts := &slog.HandlerOptions{Level: level}
+	if *logPath == "" {
+		// The screen doesn't need every line timestamped
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, opts)))
+		return nil
+	}
+	f, err := os.OpenFile(*logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
 	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(f, opts)).With("run", runID))
+	return nil
 
 }
 
-func processDDQ() {
+// skipDocument moves pdf into the SKIPPED_FOLDER of the output folder
+func skipDocument(pdf string, folder string) error {
 
-	if !*silent {
-		fmt.Println("Processing DDs ...")
+	dest := filepath.Join(folder, SKIPPED_FOLDER)
+	if !*dryrun {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
 	}
-	formatDDPage2s()
-	generatePDFs(CFG.Crninja.Crdouble)
+	return renameFile(pdf, filepath.Join(dest, filepath.Base(pdf)))
+
+}
+
+func sqldate(tm time.Time) string {
+
+	const datefmt = "2006-01-02"
 
+	return "'" + tm.Format(datefmt) + "'"
 }
 
-func processLetterQ() {
+// sqlDialect is the dialect of the configured MySQL.Driver
+func sqlDialect() dialect {
 
-	if !*silent {
-		fmt.Println("Processing letters ... ")
+	if d, ok := dialects[CFG.MySQL.Driver]; ok {
+		return d
 	}
-	generatePDFs(CFG.Crninja.Crletters)
+	return dialects[DRIVER_MYSQL]
 
 }
 
-func replaceFields(txt string, planno string) string {
+// sqlplanno renders a plan number for inclusion in SQL, quoted or not
+// according to the configured PlanNoType
+func sqlplanno(planno string) string {
 
-	//Field types held in tStdLetterFields
-	const FIELD_VALUE_TYPE_TEXT = 0
-	const FIELD_VALUE_TYPE_INTEGER = 1
-	const FIELD_VALUE_TYPE_CURRENCY = 2
-	const FIELD_VALUE_TYPE_DATE = 3
+	if planNoIsString() {
+		return "'" + safesql(planno) + "'"
+	}
+	return safesql(planno)
+}
 
-	var res string
+// statusAction looks up the configured action for a RecordStatus. For
+// STATUS_TEMPLATE the Terms key to use is also returned.
+func statusAction(status string) (string, string) {
 
-	res = txt
-	rfldx, _ := regexp.Compile(`\[\[(\w+)\]\]`)
-	rflds := rfldx.FindAllStringSubmatch(txt, -1)
-	for i := 0; i < len(rflds); i++ {
-		fld := safesql(rflds[i][1])
-		xsql := "SELECT FieldSQL FROM tstdletterfields WHERE FieldID='" + fld + "'"
-		fieldSQL := getStringFromDB(xsql, "")
-		if fieldSQL == "" {
+	action, ok := CFG.Email.StatusActions[status]
+	if !ok || action == "" {
+		return STATUS_PROCESS, ""
+	}
+	if strings.HasPrefix(action, STATUS_TEMPLATE+":") {
+		return STATUS_TEMPLATE, strings.TrimPrefix(action, STATUS_TEMPLATE+":")
+	}
+	return action, ""
+}
+
+// storeSecured hands a finished document to the configured store,
+// remembering where it went for emailSecurePDF. False means the upload
+// failed and the document has been left for review.
+func storeSecured(pdf string, planno string) bool {
+
+	if *dryrun {
+		return true
+	}
+	ref, err := store.Put(pdf)
+	if err != nil {
+		routeToReview(pdf, planno, err.Error())
+		return false
+	}
+	if ref != pdf {
+		storedAs[pdf] = ref
+	}
+	return true
+
+}
+
+// streamConfigured reports whether any letter or DD stream is called name
+func streamConfigured(name string) bool {
+
+	for _, whichq := range CFG.Crninja.Streams {
+		if whichq.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// streamList combines an original single stream, if configured, with any
+// further streams of the same type, for normaliseStreams
+func streamList(legacy STREAM, legacyName string, more []STREAM) []STREAM {
+
+	var res []STREAM
+	if legacy.Table != "" {
+		if legacy.Name == "" {
+			legacy.Name = legacyName
+		}
+		res = append(res, legacy)
+	}
+	for i, whichq := range more {
+		if whichq.Name == "" {
+			whichq.Name = legacyName + strconv.Itoa(i+2)
+		}
+		res = append(res, whichq)
+	}
+	return res
+}
+
+// streamStage is the -stages stage that generates whichq
+func streamStage(whichq STREAM) string {
+
+	if whichq.FormatPage2 {
+		return "dds"
+	}
+	return "letters"
+}
+
+// testPDF returns a minimal blank single page PDF
+func testPDF() []byte {
+
+	objs := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >>",
+	}
+	var sb strings.Builder
+	sb.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objs))
+	for i, obj := range objs {
+		offsets[i] = sb.Len()
+		fmt.Fprintf(&sb, "%d 0 obj\n%v\nendobj\n", i+1, obj)
+	}
+	xref := sb.Len()
+	fmt.Fprintf(&sb, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&sb, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&sb, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, xref)
+	return []byte(sb.String())
+
+}
+
+// uniqueFilename returns fname with the lowest numeric suffix that
+// doesn't clash with an existing file
+func uniqueFilename(fname string) string {
+
+	ext := filepath.Ext(fname)
+	base := strings.TrimSuffix(fname, ext)
+	for n := 2; ; n++ {
+		res := base + "-" + strconv.Itoa(n) + ext
+		if _, err := os.Stat(res); os.IsNotExist(err) {
+			return res
+		}
+	}
+
+}
+
+// validateConfig checks the settings we can without the database,
+// returning a description of each problem found
+func validateConfig() []string {
+
+	var problems []string
+	problem := func(format string, a ...any) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	required := map[string]string{
+		"MySQL.Server":   CFG.MySQL.Server,
+		"MySQL.Database": CFG.MySQL.Database,
+		"MySQL.Userid":   CFG.MySQL.Userid,
+		"Pdftk.Exec":     CFG.Pdftk.Exec,
+		"Pdftk.Folder":   CFG.Pdftk.Folder,
+	}
+	if wantStage("letters") || wantStage("dds") {
+		required["Crninja.Exec"] = CFG.Crninja.Exec
+	}
+	var names []string
+	for name := range required {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if required[name] == "" {
+			problem("%v must be set", name)
+		}
+	}
+
+	for _, name := range []string{"Pdftk.Exec", "Crninja.Exec"} {
+		if required[name] == "" {
 			continue
 		}
-		xsql = "SELECT FieldValueType FROM tstdletterfields WHERE FieldID='" + fld + "'"
-		fieldType := getIntegerFromDB(xsql, FIELD_VALUE_TYPE_TEXT)
+		if _, err := exec.LookPath(required[name]); err != nil {
+			problem("%v %v is not an executable: %v", name, required[name], err)
+		}
+	}
 
-		xsql = "SELECT " + fieldSQL + "  WHERE PlanNo=" + planno
-		xnew := ""
+	if CFG.Pdftk.Folder != "" {
+		if fi, err := os.Stat(CFG.Pdftk.Folder); err != nil {
+			problem("Pdftk.Folder %v: %v", CFG.Pdftk.Folder, err)
+		} else if !fi.IsDir() {
+			problem("Pdftk.Folder %v is not a folder", CFG.Pdftk.Folder)
+		} else if f, err := os.CreateTemp(CFG.Pdftk.Folder, ".pdfwrap-*"); err != nil {
+			problem("Pdftk.Folder %v is not writable: %v", CFG.Pdftk.Folder, err)
+		} else {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
 
-		switch fieldType {
-		case FIELD_VALUE_TYPE_CURRENCY:
-			xval := getFloatFromDB(xsql, 0.00)
-			xnew = "£" + strconv.FormatFloat(xval, 'E', 2, 64)
-		case FIELD_VALUE_TYPE_DATE:
-			xval := getStringFromDB(xsql, "2004-01-01")
-			xnew = formatDate(xval)
-		case FIELD_VALUE_TYPE_INTEGER:
-			xval := getIntegerFromDB(xsql, 0)
-			xnew = strconv.FormatInt(xval, 10)
-		default:
-			xnew = getStringFromDB(xsql, "")
+	if _, err := compileMask(CFG.Pdftk.PDFMask); err != nil {
+		problem("Pdftk.PDFMask %v doesn't compile: %v", CFG.Pdftk.PDFMask, err)
+	}
+	for _, pattern := range CFG.Crninja.FailPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			problem("Crninja.FailPatterns entry %v doesn't compile: %v", pattern, err)
 		}
-		res = strings.ReplaceAll(res, "[["+fld+"]]", xnew)
+	}
 
+	if !slices.Contains([]string{NOWORK_PROCEED, NOWORK_EXIT, NOWORK_SKIPSECURE}, CFG.Crninja.OnNoWork) {
+		problem("Unknown OnNoWork %v, must be one of %v, %v or %v", CFG.Crninja.OnNoWork, NOWORK_PROCEED, NOWORK_EXIT, NOWORK_SKIPSECURE)
+	}
+	if _, ok := dialects[CFG.MySQL.Driver]; !ok {
+		problem("Unsupported MySQL.Driver %v, must be %v or %v", CFG.MySQL.Driver, DRIVER_MYSQL, DRIVER_POSTGRES)
+	}
+	for code, how := range CFG.Crninja.DeliveryMethods {
+		if !slices.Contains([]string{DELIVER_EMAIL, DELIVER_PAPER, DELIVER_PORTAL, DELIVER_SKIP}, how) {
+			problem("Unknown delivery method %v for DelMeth %v, must be one of %v, %v, %v or %v", how, code, DELIVER_EMAIL, DELIVER_PAPER, DELIVER_PORTAL, DELIVER_SKIP)
+		}
+		if how == DELIVER_PAPER && CFG.Pdftk.PaperFolder == "" {
+			problem("DelMeth %v is routed to paper so Pdftk.PaperFolder must be set", code)
+		}
+	}
+	if CFG.Email.Delivery != DELIVERY_QUEUE && CFG.Email.Delivery != DELIVERY_SMTP {
+		problem("Unknown Email.Delivery %v, must be %v or %v", CFG.Email.Delivery, DELIVERY_QUEUE, DELIVERY_SMTP)
+	}
+	if CFG.Email.Delivery == DELIVERY_SMTP && (CFG.Email.SMTP.Host == "" || CFG.Email.SMTP.From == "") {
+		problem("Email.SMTP.Host and From must be set to send emails by SMTP")
+	}
+	if CFG.Email.NotifyAddress != "" && (CFG.Email.SMTP.Host == "" || CFG.Email.SMTP.From == "") {
+		problem("Email.SMTP.Host and From must be set to send run summaries to Email.NotifyAddress")
+	}
+	if len(CFG.Email.PlanFields) > len(planDataColumns) {
+		problem("Email.PlanFields has %v labels but there are only %v plan details, use ExtraPlanColumns for more", len(CFG.Email.PlanFields), len(planDataColumns))
+	}
+	for _, col := range CFG.Email.ExtraPlanColumns {
+		if col != "" && !regexp.MustCompile(`^\w+$`).MatchString(col) {
+			problem("Email.ExtraPlanColumns entry %v isn't a column name", col)
+		}
+	}
+	switch CFG.Pdftk.ShortPasswordAction {
+	case "", SHORTPW_PAD, SHORTPW_REVIEW:
+	case SHORTPW_RANDOM:
+		if CFG.Pdftk.RandomPasswordColumn == "" {
+			problem("Pdftk.RandomPasswordColumn must be set for ShortPasswordAction %v, or customers can't be told their password", SHORTPW_RANDOM)
+		}
+	default:
+		problem("Unknown Pdftk.ShortPasswordAction %v, must be %v, %v or %v", CFG.Pdftk.ShortPasswordAction, SHORTPW_PAD, SHORTPW_RANDOM, SHORTPW_REVIEW)
+	}
+	for name, field := range map[string]string{"Pdftk.PasswordField": CFG.Pdftk.PasswordField, "Pdftk.PasswordFallback": CFG.Pdftk.PasswordFallback, "Pdftk.RandomPasswordColumn": CFG.Pdftk.RandomPasswordColumn} {
+		if field != "" && !regexp.MustCompile(`^\w+$`).MatchString(field) {
+			problem("%v %v isn't a field name", name, field)
+		}
+	}
+	for _, allow := range CFG.Pdftk.Allow {
+		if _, ok := allowKeywords[strings.ToLower(allow)]; !ok {
+			problem("Unknown Pdftk.Allow %v, must be print, highresprint, copy, modify or annotate", allow)
+		}
+	}
+	if CFG.Pdftk.Tool != TOOL_PDFTK && CFG.Pdftk.Tool != TOOL_QPDF {
+		problem("Unknown Pdftk.Tool %v, must be %v or %v", CFG.Pdftk.Tool, TOOL_PDFTK, TOOL_QPDF)
+	}
+	if CFG.Pdftk.Tool == TOOL_QPDF && (CFG.Pdftk.Infofile != "" || CFG.Pdftk.InfoPerFile || CFG.Pdftk.InfoFromPlan) {
+		problem("qpdf can't update document info so Pdftk.Infofile, InfoPerFile and InfoFromPlan must be unset")
 	}
+	if CFG.Pdftk.OwnerPass == "" && CFG.Pdftk.NoUserPassword {
+		problem("Pdftk.OwnerPass must be set if NoUserPassword is")
+	}
+	return problems
 
-	return res
 }
 
-func runPdftk(args []string) {
+// validateTemplate checks that every [[field]] used by a standard letter
+// is defined in tstdletterfields and that its SQL runs for a sample plan
+func validateTemplate(ltrid string) bool {
 
-	argx := args
-	if CFG.Pdftk.FinalArgs != "" {
-		argx = append(args, CFG.Pdftk.FinalArgs)
+	txt := getStringFromDB("SELECT Concat_WS('\n',HdrHeader,LtrBody,FtrFooter) "+FETCHTEXT, "", ltrid)
+	if txt == "" {
+		slog.Error("Letter not found or empty", "Ltrid", ltrid)
+		return false
 	}
-	if *debug {
-		fmt.Printf(`PDFTK: "%v" %v`+"\n", CFG.Pdftk.Exec, strings.Join(argx, " "))
+	planno := *samplePlan
+	if planno == "" {
+		planno = getStringFromDB("SELECT PlanNo FROM tcustomers LIMIT 1", "0")
+	}
+	slog.Info("Validating letter", "Ltrid", ltrid, "PlanNo", planno)
+
+	rfldx, _ := regexp.Compile(`\[\[(\w+)\]\]`)
+	checked := make(map[string]bool)
+	nbad := 0
+	for _, m := range rfldx.FindAllStringSubmatch(txt, -1) {
+		fld := m[1]
+		if checked[fld] {
+			continue
+		}
+		checked[fld] = true
+		def, err := letterField(fld)
+		if err != nil {
+			slog.Error("Cannot read letter fields", "err", err)
+			return false
+		}
+		fieldSQL := def.SQL
+		if fieldSQL == "" {
+			slog.Error("Field not defined in tstdletterfields", "field", fld)
+			nbad++
+			continue
+		}
+		xsql := "SELECT " + fieldSQL + "  WHERE PlanNo=?"
+		dbAcquire()
+		ctx, cancel := dbContext()
+		rows, err := DB.QueryContext(ctx, rebind(xsql), planno)
+		if err == nil {
+			rows.Close()
+		}
+		cancel()
+		dbRelease()
+		if err != nil {
+			slog.Error("Field SQL fails", "field", fld, "err", err)
+			nbad++
+			continue
+		}
+		slog.Debug("Field OK", "field", fld)
 	}
-	cmd := exec.Command(CFG.Pdftk.Exec, argx...)
-	err := cmd.Run()
-	checkerr(err)
+	if nbad > 0 {
+		slog.Error("Letter fields have problems", "count", len(checked), "problems", nbad)
+	} else {
+		slog.Info("Letter fields checked", "count", len(checked))
+	}
+	return nbad == 0
 
 }
 
-func runsql(xsql string) {
+// verifyAudit checks the signature chain of each run's audit records,
+// reporting any that have been altered, added or removed
+func verifyAudit(runid string) bool {
 
-	if *debug {
-		fmt.Println(xsql)
+	if CFG.MySQL.AuditTable == "" || auditKey == nil {
+		slog.Error("Both AuditTable and AuditKeyEnv must be configured to verify the audit")
+		return false
+	}
+
+	xsql := "SELECT RunID,Seq,LoggedAt,Action,PlanNo,Detail,Signature FROM " + CFG.MySQL.AuditTable
+	xsql += " WHERE Signature IS NOT NULL"
+	if runid != "all" {
+		xsql += " AND RunID='" + safesql(runid) + "'"
+	}
+	xsql += " ORDER BY RunID,Seq"
+	slog.Debug("Query", "sql", xsql)
+
+	ok := true
+	nrecs := 0
+	lastRun := ""
+	prev := ""
+	seq := 0
+	dbAcquire()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, xsql)
+	if err != nil {
+		dbRelease()
+		slog.Error("Cannot read audit", "table", CFG.MySQL.AuditTable, "err", err)
+		return false
+	}
+	for rows.Next() {
+		var run, action, planno, detail, sig string
+		var recseq int
+		var loggedAt auditTime
+		if err := rows.Scan(&run, &recseq, &loggedAt, &action, &planno, &detail, &sig); err != nil {
+			slog.Error("Cannot read audit record", "table", CFG.MySQL.AuditTable, "err", err)
+			ok = false
+			break
+		}
+		if run != lastRun {
+			lastRun = run
+			prev = ""
+			seq = 0
+		}
+		seq++
+		nrecs++
+		if recseq != seq {
+			slog.Error("Audit record missing or out of place", "run", run, "seq", seq, "found", recseq)
+			ok = false
+			seq = recseq
+		}
+		want := auditSignature(prev, run, recseq, loggedAt.Format(time.DateTime), action, planno, detail)
+		if !hmac.Equal([]byte(want), []byte(sig)) {
+			slog.Error("Audit record altered", "run", run, "seq", recseq, "action", action, "PlanNo", planno)
+			ok = false
+		}
+		prev = sig
+	}
+	rows.Close()
+	dbRelease()
+
+	if ok {
+		slog.Info("Audit records verified", "count", nrecs)
+	} else {
+		slog.Error("Audit verification failed", "count", nrecs)
 	}
-	_, err := DBH.Exec(xsql)
-	checkerr(err)
+	return ok
+
 }
 
-func safesql(x string) string {
+// wantPageCount says whether emails need the #PageCount# of their documents
+func wantPageCount() bool {
 
-	var sb strings.Builder
-	for i := 0; i < len(x); i++ {
-		c := x[i]
-		switch c {
-		case '\\', 0, '\n', '\r', '\'', '"':
-			sb.WriteByte('\\')
-			sb.WriteByte(c)
-		case '\032':
-			sb.WriteByte('\\')
-			sb.WriteByte('Z')
-		default:
-			sb.WriteByte(c)
+	return CFG.Email.IncludePageCount && strings.Contains(CFG.Email.Bodytext, "PageCount")
+
+}
+
+// wantStage reports whether stage should run given -stages or -only
+func wantStage(stage string) bool {
+
+	return len(runStages) == 0 || slices.Contains(runStages, stage)
+}
+
+// wantStream reports whether whichq should run given the -stream flag
+func wantStream(whichq STREAM) bool {
+
+	return *streamName == "" || *streamName == whichq.Name
+}
+
+// workFolder is where anything made from Pdftk.Folder is written, the
+// sandbox when sandboxed. Blanks, stamps and separators are still read
+// from Pdftk.Folder itself.
+func workFolder() string {
+
+	if sandboxed {
+		return sandboxFolder
+	}
+	return CFG.Pdftk.Folder
+
+}
+
+// workWaiting reports whether any queue this run would process has
+// records waiting, used by Crninja.OnNoWork
+func workWaiting() bool {
+
+	for _, whichq := range CFG.Crninja.Streams {
+		if !wantStream(whichq) {
+			continue
+		}
+		if whichq.FormatPage2 && (wantStage("dds") || wantStage("dd-format")) {
+			if getIntegerFromDB("SELECT COUNT(*) FROM "+whichq.Table+" WHERE edited=0", 0) > 0 {
+				return true
+			}
+		}
+		if !wantStage(streamStage(whichq)) {
+			continue
+		}
+		countsql := whichq.CountSQL
+		if countsql == "" {
+			countsql = DEFAULT_COUNTSQL
+		}
+		if getIntegerFromDB(expandStreamSQL(countsql, whichq, 0), 0) > 0 {
+			return true
 		}
 	}
-	return sb.String()
+	slog.Debug("No work waiting in any queue")
+	return false
+
 }
 
-func sqldate(tm time.Time) string {
+// writeReport saves the run's totals to -report, if given, as JSON
+func writeReport(exitCode int) {
 
-	const datefmt = "2006-01-02"
+	if *reportPath == "" {
+		return
+	}
+	stats.End = time.Now()
+	stats.ExitCode = exitCode
+	js, err := json.MarshalIndent(stats, "", "  ")
+	if err == nil {
+		err = os.WriteFile(*reportPath, append(js, '\n'), 0644)
+	}
+	if err != nil {
+		slog.Error("Cannot write report", "file", *reportPath, "err", err)
+	}
 
-	return "'" + tm.Format(datefmt) + "'"
 }
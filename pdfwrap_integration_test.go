@@ -0,0 +1,221 @@
+//go:build integration
+
+// The whole pipeline, from claiming a letter stream's records to queueing
+// the emails, run against a real MySQL loaded with testdata/pipeline.sql
+// and with stand-ins for CRNINJA and pdftk.
+//
+// Set TEST_PDFWRAP_DSN to a scratch database, whose fixture tables are
+// replaced, and run with go test -tags integration, eg
+//
+//	TEST_PDFWRAP_DSN='test:test@tcp(127.0.0.1:3306)/pdfwrap_test' go test -tags integration
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The test binary runs as pdfwrap itself when this is set, see runPdfwrap
+const RUN_AS_PDFWRAP = "TEST_PDFWRAP_MAIN"
+
+func TestMain(m *testing.M) {
+
+	if os.Getenv(RUN_AS_PDFWRAP) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+
+}
+
+// Stand-ins for CRNINJA and pdftk, which write a token PDF wherever the
+// real tools would and log their arguments to commands.log
+const fakeCrninja = `#!/bin/sh
+echo "crninja $*" >> "$(dirname "$0")/commands.log"
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-O" ]; then printf '%%PDF-1.4 crninja\n' > "$2"; fi
+	shift
+done
+`
+
+const fakePdftk = `#!/bin/sh
+echo "pdftk $*" >> "$(dirname "$0")/commands.log"
+while [ $# -gt 0 ]; do
+	case "$1" in
+	dump_data) echo "NumberOfPages: 2" ;;
+	output) printf '%%PDF-1.4 pdftk\n' > "$2" ;;
+	esac
+	shift
+done
+`
+
+// fixtureDB connects to the TEST_PDFWRAP_DSN database and loads the
+// fixture into it, skipping the test if there's no database to use
+func fixtureDB(t *testing.T) (*sql.DB, *mysql.Config) {
+
+	t.Helper()
+	dsn := os.Getenv("TEST_PDFWRAP_DSN")
+	if dsn == "" {
+		t.Skip("TEST_PDFWRAP_DSN not set")
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("TEST_PDFWRAP_DSN: %v", err)
+	}
+	cfg.MultiStatements = true
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	fixture, err := os.ReadFile(filepath.Join("testdata", "pipeline.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(fixture)); err != nil {
+		t.Fatalf("loading fixture: %v", err)
+	}
+	return db, cfg
+
+}
+
+// fixtureConfig writes the fake tools and a configuration using them and
+// db into a temporary folder, returning the folder and configuration
+func fixtureConfig(t *testing.T, db *mysql.Config) (string, string) {
+
+	t.Helper()
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "out")
+	if err := os.Mkdir(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range map[string]string{"crninja": fakeCrninja, "pdftk": fakePdftk} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := fmt.Sprintf(`mysql:
+  server: %q
+  userid: %q
+  password: %q
+  database: %q
+pdftk:
+  exec: %q
+  folder: %q
+  pdfmask: '^ltr-.*\.pdf$'
+  infofile: info.txt
+  pdfprefix: ltr-
+  pdfprefix2: tm2-
+  pdfprefix3: sec-
+  ownerpass: owner
+crninja:
+  exec: %q
+  dbaccess: -U report
+  crletters:
+    rpt: letter.rpt
+    table: tletterqq
+    planno: PlanNo
+    ltrid: LtrID
+email:
+  subject: Your documents
+  bodytext: 'Dear #DearSir#, your #Product# plan'
+  planfields: [Product]
+  terms:
+    Gold: %q
+`, db.Addr, db.User, db.Passwd, db.DBName, filepath.Join(dir, "pdftk"), folder,
+		filepath.Join(dir, "crninja"), filepath.Join(dir, "gold-terms.pdf"))
+	cfgfile := filepath.Join(dir, "pdfwrap.yml")
+	if err := os.WriteFile(cfgfile, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return folder, cfgfile
+
+}
+
+// runPdfwrap runs the program with args, as a separate process so that
+// its exits and flags are its own
+func runPdfwrap(t *testing.T, args ...string) {
+
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), RUN_AS_PDFWRAP+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("pdfwrap %v: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+}
+
+func TestPipeline(t *testing.T) {
+
+	db, dbcfg := fixtureDB(t)
+	folder, cfgfile := fixtureConfig(t, dbcfg)
+
+	runPdfwrap(t, "-cfg", cfgfile, "-only", "letters")
+	runPdfwrap(t, "-cfg", cfgfile, "-only", "secure")
+
+	for _, f := range []string{"sec-1001-5.pdf", "sec-1002-7.pdf"} {
+		if _, err := os.Stat(filepath.Join(folder, f)); err != nil {
+			t.Errorf("no secured %v: %v", f, err)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(folder, "ltr-*")); len(left) > 0 {
+		t.Errorf("originals left behind: %v", left)
+	}
+
+	rows, err := db.Query("SELECT PlanNo, PrintBatch FROM tletterqq ORDER BY PlanNo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var planno, batch int
+		if err := rows.Scan(&planno, &batch); err != nil {
+			t.Fatal(err)
+		}
+		if claimed := batch > 0; claimed != (planno != 1003) {
+			t.Errorf("plan %v has PrintBatch %v", planno, batch)
+		}
+	}
+
+	type email struct{ PlanNo, To, Body, Attachments string }
+	var got []email
+	erows, err := db.Query("SELECT PlanNo, ToAddress, MsgText, Attachments FROM toutgoingemails ORDER BY PlanNo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer erows.Close()
+	for erows.Next() {
+		var e email
+		if err := erows.Scan(&e.PlanNo, &e.To, &e.Body, &e.Attachments); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	want := []email{
+		{"1001", "ann@example.com", "Dear Mrs Smith, your Gold plan", filepath.Join(folder, "sec-1001-5.pdf")},
+		{"1002", "bob@example.com", "Dear B Jones, your Gold plan", filepath.Join(folder, "sec-1002-7.pdf")},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("emails queued\n%v\nwant\n%v", got, want)
+	}
+
+	commands, err := os.ReadFile(filepath.Join(filepath.Dir(folder), "commands.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"user_pw 01234567890", "user_pw 07700900123"} {
+		if !strings.Contains(string(commands), want) {
+			t.Errorf("no pdftk run with %q in\n%s", want, commands)
+		}
+	}
+
+}
@@ -0,0 +1,1435 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResult is the canned answer to a query
+type stubResult struct {
+	cols []string
+	rows [][]any
+}
+
+// stubDB is a Database answering queries from a function and recording
+// everything run against it
+type stubDB struct {
+	answer  func(xsql string, args []any) stubResult
+	failing string // Statements containing this fail
+
+	mu         sync.Mutex
+	queries    []string
+	execs      []string
+	committed  bool
+	rolledBack bool
+}
+
+func (d *stubDB) QueryContext(ctx context.Context, query string, args ...any) (Rows, error) {
+	d.mu.Lock()
+	d.queries = append(d.queries, query)
+	d.mu.Unlock()
+	if d.failing != "" && strings.Contains(query, d.failing) {
+		return nil, errors.New("stub failure")
+	}
+	var res stubResult
+	if d.answer != nil {
+		res = d.answer(query, args)
+	}
+	return &stubRows{res: res}, nil
+}
+
+func (d *stubDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.execs = append(d.execs, query)
+	if d.failing != "" && strings.Contains(query, d.failing) {
+		return nil, errors.New("stub failure")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (d *stubDB) Conn(ctx context.Context) (DBConn, error) {
+	return stubConn{d}, nil
+}
+
+// stubConn is both the session and its transaction
+type stubConn struct{ *stubDB }
+
+func (c stubConn) BeginTx(ctx context.Context) (DBTx, error) { return c, nil }
+func (c stubConn) Close() error                              { return nil }
+
+func (c stubConn) Commit() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.committed = true
+	return nil
+}
+
+// Rollback after Commit does nothing, as with sql.Tx
+func (c stubConn) Rollback() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rolledBack = !c.committed
+	return nil
+}
+
+type stubRows struct {
+	res stubResult
+	pos int
+}
+
+func (r *stubRows) Next() bool {
+	r.pos++
+	return r.pos <= len(r.res.rows)
+}
+
+func (r *stubRows) Scan(dest ...any) error {
+	row := r.res.rows[r.pos-1]
+	if len(dest) != len(row) {
+		return fmt.Errorf("scanning %v columns into %v", len(row), len(dest))
+	}
+	for i, d := range dest {
+		if s, ok := d.(sql.Scanner); ok {
+			if err := s.Scan(row[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		switch d := d.(type) {
+		case *string:
+			*d = fmt.Sprint(row[i])
+		case *int64:
+			*d = row[i].(int64)
+		case *int:
+			*d = int(row[i].(int64))
+		case *float64:
+			*d = row[i].(float64)
+		default:
+			return fmt.Errorf("can't scan into %T", d)
+		}
+	}
+	return nil
+}
+
+func (r *stubRows) Columns() ([]string, error) { return r.res.cols, nil }
+func (r *stubRows) Err() error                 { return nil }
+func (r *stubRows) Close() error               { return nil }
+
+// useStubDB points the database helpers at db for the rest of the test
+func useStubDB(t *testing.T, db *stubDB) {
+
+	t.Helper()
+	saveDB, saveSem, saveCtx := DB, dbsem, dbCtx
+	DB, dbsem, dbCtx = db, make(chan struct{}, 1), context.Background()
+	fieldDefs, fieldDefsErr, fieldDefsOnce = nil, nil, sync.Once{}
+	fieldCache = make(map[string]map[string]string)
+	t.Cleanup(func() {
+		DB, dbsem, dbCtx = saveDB, saveSem, saveCtx
+		fieldDefs, fieldDefsErr, fieldDefsOnce = nil, nil, sync.Once{}
+	})
+
+}
+
+// fieldsDB defines the letter fields in defs, FieldID => FieldSQL and
+// type, answering their lookups from values, FieldSQL => value
+func fieldsDB(defs map[string]fieldDef, values map[string]any) *stubDB {
+
+	return &stubDB{answer: func(xsql string, args []any) stubResult {
+		if strings.Contains(xsql, "FROM tstdletterfields") {
+			var res stubResult
+			for id, def := range defs {
+				res.rows = append(res.rows, []any{id, def.SQL, def.Type})
+			}
+			return res
+		}
+		for fieldSQL, v := range values {
+			if strings.HasPrefix(xsql, "SELECT "+fieldSQL+" ") {
+				return stubResult{rows: [][]any{{v}}}
+			}
+		}
+		return stubResult{}
+	}}
+
+}
+
+func TestReplaceFields(t *testing.T) {
+
+	db := fieldsDB(map[string]fieldDef{
+		"Surname": {SQL: "cLastname FROM tcustomers", Type: FIELD_VALUE_TYPE_TEXT},
+		"Term":    {SQL: "Term FROM tplans", Type: FIELD_VALUE_TYPE_INTEGER},
+		"Ref":     {SQL: "Ref FROM tplans", Type: FIELD_VALUE_TYPE_TEXT},
+	}, map[string]any{
+		"cLastname FROM tcustomers": "Smith",
+		"Term FROM tplans":          int64(12),
+		"Ref FROM tplans":           nil,
+	})
+	useStubDB(t, db)
+
+	got, err := replaceFields("Dear [[Surname]], [[Term]] months, ref [[Ref]], [[Unknown]] [[surname]]", "42")
+	want := "Dear Smith, 12 months, ref , [[Unknown]] Smith"
+	if err != nil || got != want {
+		t.Errorf("replaceFields = %q, want %q", got, want)
+	}
+	if n := strings.Count(strings.Join(db.queries, "\n"), "FROM tstdletterfields"); n != 1 {
+		t.Errorf("field definitions read %v times, want once", n)
+	}
+
+}
+
+func TestReplaceFieldsUndefined(t *testing.T) {
+
+	useStubDB(t, &stubDB{failing: "tstdletterfields"})
+	if got, err := replaceFields("Dear [[Surname]]", "42"); err == nil {
+		t.Errorf("replaceFields = %q without field definitions, want an error", got)
+	}
+	if err := formatDDPage2s(STREAM{Table: "dd_notify"}); err == nil {
+		t.Error("formatDDPage2s carried on without field definitions")
+	}
+
+}
+
+func TestGetFromDBDefaults(t *testing.T) {
+
+	useStubDB(t, &stubDB{answer: func(xsql string, args []any) stubResult {
+		switch {
+		case strings.Contains(xsql, "nulls"):
+			return stubResult{rows: [][]any{{nil}}}
+		case strings.Contains(xsql, "values"):
+			return stubResult{rows: [][]any{{"7"}}}
+		}
+		return stubResult{}
+	}})
+
+	for _, c := range []struct {
+		xsql string
+		want string
+	}{
+		{"SELECT x FROM values", "7"},
+		{"SELECT x FROM nulls", "default"},
+		{"SELECT x FROM nothing", "default"},
+	} {
+		if got := getStringFromDB(c.xsql, "default"); got != c.want {
+			t.Errorf("getStringFromDB(%q) = %q, want %q", c.xsql, got, c.want)
+		}
+	}
+	if got := getIntegerFromDB("SELECT x FROM nulls", -1); got != -1 {
+		t.Errorf("getIntegerFromDB of NULL = %v, want the default", got)
+	}
+	if got := getIntegerFromDB("SELECT x FROM values", -1); got != 7 {
+		t.Errorf("getIntegerFromDB = %v, want 7", got)
+	}
+
+}
+
+// smtpServer accepts one message on a local port, recording its
+// envelope recipients and content
+type smtpServer struct {
+	port  int
+	rcpts []string
+	data  string
+	done  chan struct{}
+}
+
+func startSMTP(t *testing.T) *smtpServer {
+
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &smtpServer{port: ln.Addr().(*net.TCPAddr).Port, done: make(chan struct{})}
+	go func() {
+		defer close(srv.done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 localhost")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				srv.rcpts = append(srv.rcpts, strings.Trim(line[len("RCPT TO:"):], "<>"))
+				tc.PrintfLine("250 OK")
+			case cmd == "DATA":
+				tc.PrintfLine("354 Go ahead")
+				b, _ := io.ReadAll(tc.DotReader())
+				srv.data = string(b)
+				tc.PrintfLine("250 OK")
+			case cmd == "QUIT":
+				tc.PrintfLine("221 Bye")
+				return
+			default:
+				tc.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return srv
+
+}
+
+// useSMTP points Email.SMTP at srv for the rest of the test
+func useSMTP(t *testing.T, srv *smtpServer) {
+
+	save := CFG.Email.SMTP
+	t.Cleanup(func() { CFG.Email.SMTP = save })
+	CFG.Email.SMTP = SMTP{Host: "127.0.0.1", Port: srv.port, From: "letters@example.com"}
+
+}
+
+func TestSendMailBcc(t *testing.T) {
+
+	srv := startSMTP(t)
+	useSMTP(t, srv)
+	if err := sendMail([]string{"ann@example.com"}, []string{"audit@example.com"}, "Your documents", "Hello", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-srv.done
+	if want := []string{"ann@example.com", "audit@example.com"}; !slices.Equal(srv.rcpts, want) {
+		t.Errorf("recipients %v, want %v", srv.rcpts, want)
+	}
+	headers, _, _ := strings.Cut(srv.data, "\n\n") // DotReader leaves bare newlines
+	if strings.Contains(headers, "audit@example.com") {
+		t.Errorf("Bcc address in the headers:\n%v", headers)
+	}
+	if !strings.Contains(headers, "To: ann@example.com") {
+		t.Errorf("no To: header for the customer in:\n%v", headers)
+	}
+
+}
+
+func TestPlanFieldsLabels(t *testing.T) {
+
+	save := CFG.Email
+	t.Cleanup(func() { CFG.Email = save })
+	CFG.Email.PlanFields = []string{"Product", "Email", "Phone"}
+	CFG.Email.ExtraPlanColumns = []string{"cMobile"}
+	db := &stubDB{answer: func(xsql string, args []any) stubResult {
+		row := []any{"Gold", "ann@example.com", "01234 567890", "AB1 2CD", "Mrs", "Ann", "Smith", "", "Live", "42", "07700 900123"}
+		return stubResult{cols: append(slices.Clone(planDataColumns), "cMobile"), rows: [][]any{row}}
+	}}
+	useStubDB(t, db)
+
+	plandata := getPlanData("42")
+	if plandata == nil {
+		t.Fatalf("no plan data from %v", db.queries)
+	}
+	if q := db.queries[0]; strings.Contains(q, "COALESCE(Email") || !strings.Contains(q, "COALESCE(cMobile,'')") {
+		t.Errorf("plan data query %v", q)
+	}
+	fields := planFields(plandata)
+	if fields["Email"] != "ann@example.com" || fields["Phone"] != "01234 567890" || fields["cMobile"] != "07700 900123" {
+		t.Errorf("planFields gave %v", fields)
+	}
+	if pw := planPassword("Phone", plandata, "42"); pw != "01234567890" {
+		t.Errorf("password from the Phone label is %q", pw)
+	}
+
+}
+
+func TestNotifyOperatorsStopped(t *testing.T) {
+
+	srv := startSMTP(t)
+	useSMTP(t, srv)
+	save := CFG.Email.NotifyAddress
+	t.Cleanup(func() { CFG.Email.NotifyAddress = save })
+	CFG.Email.NotifyAddress = "ops@example.com"
+
+	notifyOperators("Generation failed: no database")
+	<-srv.done
+	if !strings.Contains(srv.data, "PROBLEMS") || !strings.Contains(srv.data, "Generation failed: no database") {
+		t.Errorf("summary doesn't say why the run stopped:\n%v", srv.data)
+	}
+
+}
+
+func TestValidateConfigNotifyNeedsSMTP(t *testing.T) {
+
+	save := CFG.Email
+	t.Cleanup(func() { CFG.Email = save })
+	CFG.Email.NotifyAddress = "ops@example.com"
+	CFG.Email.SMTP = SMTP{}
+	want := "Email.SMTP.Host and From must be set to send run summaries to Email.NotifyAddress"
+	if problems := validateConfig(); !slices.Contains(problems, want) {
+		t.Errorf("validateConfig gave %v, want %q", problems, want)
+	}
+
+}
+
+func TestQpdfArgsPermissions(t *testing.T) {
+
+	for _, c := range []struct {
+		allow []string
+		want  string
+	}{
+		{nil, "--print=none --extract=n --modify-other=n --annotate=n --assemble=n --form=n"},
+		{[]string{"DegradedPrinting", "CopyContents"}, "--print=low --extract=y --modify-other=n --annotate=n --assemble=n --form=n"},
+	} {
+		args := []string{"in.pdf", "output", "out.pdf", "owner_pw", "owner", "user_pw", "secret"}
+		if c.allow != nil {
+			args = append(args, "allow")
+			args = append(args, c.allow...)
+		}
+		res, err := qpdfArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(res, " ")
+		if want := "in.pdf --encrypt secret owner 256 " + c.want + " -- out.pdf"; got != want {
+			t.Errorf("allowing %v, qpdf %v, want %v", c.allow, got, want)
+		}
+	}
+
+}
+
+func TestPlanFieldsSalutation(t *testing.T) {
+
+	save := CFG.Email
+	t.Cleanup(func() { CFG.Email = save })
+	CFG.Email.PlanFields = nil
+
+	for _, c := range []struct {
+		title, first, last, generic string
+		want                        string
+	}{
+		{"Mrs", "Ann", "Smith", "", "Mrs Smith"},
+		{"", "Ann", "Smith", "", "A Smith"},
+		{"", "Émile", "Zola", "", "É Zola"},
+		{"", "", "Smith", "", "Smith"},
+		{"", "", "Smith", "Sir or Madam", "Sir or Madam"},
+		{"", "", "", "", DEFAULT_SALUTATION},
+	} {
+		CFG.Email.GenericSalutation = c.generic
+		plandata := map[string]string{PD_TITLE: c.title, PD_FIRSTNAME: c.first, PD_LASTNAME: c.last}
+		if got := planFields(plandata)["DearSir"]; got != c.want {
+			t.Errorf("DearSir for %q %q %q with generic %q is %q, want %q", c.title, c.first, c.last, c.generic, got, c.want)
+		}
+	}
+
+}
+
+func TestMakeInfoFileAccents(t *testing.T) {
+
+	save := CFG.Pdftk
+	t.Cleanup(func() { CFG.Pdftk = save })
+	CFG.Pdftk.Title = "Statement\tfor <you>"
+	CFG.Pdftk.Author = "[[Adviser]] & Brontë"
+	CFG.Pdftk.InfoExtra = nil
+	useStubDB(t, fieldsDB(map[string]fieldDef{
+		"Adviser": {SQL: "cAdviser FROM tplans", Type: FIELD_VALUE_TYPE_TEXT},
+	}, map[string]any{"cAdviser FROM tplans": "Renée Müller"}))
+
+	infofile := filepath.Join(t.TempDir(), "info.txt")
+	if err := makeInfoFile(infofile, "42"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(infofile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"InfoKey: Title\nInfoValue: Statement for &lt;you&gt;\n",
+		"InfoKey: Author\nInfoValue: Ren&#233;e M&#252;ller &amp; Bront&#235;\n",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("info file has no %q in\n%s", want, b)
+		}
+	}
+
+}
+
+func TestApplyEnvironment(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	CFG.MySQL.Password = "from-yaml"
+	CFG.MySQL.Userid = "from-yaml"
+	t.Setenv("PDFWRAP_MYSQL_PASSWORD", "s3cret")
+	t.Setenv("pdfwrap_mysql_connectretries", "3")
+	t.Setenv("PDFWRAP_MYSQL_QUERYTIMEOUT", "90s")
+	t.Setenv("PDFWRAP_MYSQL_USERID", "") // Empty leaves it alone
+
+	if err := applyEnvironment(); err != nil {
+		t.Fatal(err)
+	}
+	if CFG.MySQL.Password != "s3cret" || CFG.MySQL.ConnectRetries != 3 || CFG.MySQL.QueryTimeout != 90*time.Second {
+		t.Errorf("MySQL config is %+v", CFG.MySQL)
+	}
+	if CFG.MySQL.Userid != "from-yaml" {
+		t.Errorf("empty variable changed Userid to %q", CFG.MySQL.Userid)
+	}
+
+}
+
+func TestApplyEnvironmentErrors(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	for _, c := range []struct{ name, value, want string }{
+		{"PDFWRAP_MYSQL_PASSWROD", "s3cret", "no setting MYSQL.PASSWROD"},
+		{"PDFWRAP_MYSQL_CONNECTRETRIES", "abc", "PDFWRAP_MYSQL_CONNECTRETRIES"},
+		{"PDFWRAP_MYSQL", "x", "is a section"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv(c.name, c.value)
+			err := applyEnvironment()
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("%v=%v gave %v, want an error mentioning %q", c.name, c.value, err, c.want)
+			}
+		})
+	}
+
+}
+
+func TestMimeHeaderRoundTrip(t *testing.T) {
+
+	save := CFG.Email.HeaderEncoding
+	t.Cleanup(func() { CFG.Email.HeaderEncoding = save })
+	subject := "Votre relevé annuel – plan n° 1001 pour Zoë Brontë, à conserver avec vos documents importants €"
+	for _, enc := range []string{"B", "Q"} {
+		CFG.Email.HeaderEncoding = enc
+		h := mimeHeader("Subject", subject)
+		for _, line := range strings.Split(strings.TrimSuffix(h, "\r\n"), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("%v encoded line of %v characters: %v", enc, len(line), line)
+			}
+		}
+		value, ok := strings.CutPrefix(strings.ReplaceAll(h, "\r\n ", " "), "Subject: ")
+		if !ok {
+			t.Fatalf("%v encoded header %q", enc, h)
+		}
+		got, err := new(mime.WordDecoder).DecodeHeader(strings.TrimSuffix(value, "\r\n"))
+		if err != nil || got != subject {
+			t.Errorf("%v encoded subject decodes to %q, %v, want %q", enc, got, err, subject)
+		}
+	}
+
+}
+
+func TestRedactArgs(t *testing.T) {
+
+	for _, c := range []struct{ args, want string }{
+		{"-U report -P s3cret -S db1", "-U report -P ******** -S db1"},
+		{"-U report -Ps3cret", "-U report -P********"},
+		{"in.pdf input_pw a output out.pdf owner_pw b user_pw c allow Printing", "in.pdf input_pw ******** output out.pdf owner_pw ******** user_pw ******** allow Printing"},
+		{"--password=a in.pdf --encrypt b c 256 --print=none -- out.pdf", "--password=******** in.pdf --encrypt ******** ******** 256 --print=none -- out.pdf"},
+	} {
+		if got := strings.Join(redactArgs(strings.Split(c.args, " ")), " "); got != c.want {
+			t.Errorf("redactArgs(%v) = %v, want %v", c.args, got, c.want)
+		}
+	}
+
+}
+
+func TestFormatDDPage2sOnePlan(t *testing.T) {
+
+	save := *onePlan
+	t.Cleanup(func() { *onePlan = save })
+	*onePlan = "1001"
+	db := fieldsDB(nil, nil)
+	useStubDB(t, db)
+
+	if err := formatDDPage2s(STREAM{Table: "dd_notify"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT ID, AccountRef FROM dd_notify WHERE edited=0 AND AccountRef=1001"
+	if !slices.Contains(db.queries, want) {
+		t.Errorf("queries %v, want %v", db.queries, want)
+	}
+
+}
+
+func TestNormaliseStreams(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	CFG.DDs = DDS{Page2Ltr: "77"}
+	CFG.Crninja.Crletters = STREAM{Table: "tletterqq"}
+	CFG.Crninja.Letters = []STREAM{{Table: "tletterqq2"}}
+	CFG.Crninja.Crdouble = STREAM{Table: "dd_notify"}
+	CFG.Crninja.Doubles = []STREAM{{Table: "dd_notify2", Page2: DDS{Page2Ltr: "78"}}}
+	CFG.Crninja.Streams = []STREAM{{Table: "tarrears"}, {Name: "renewals", Table: "trenewals"}}
+
+	normaliseStreams()
+	normaliseStreams() // Nothing more to move
+
+	var got []string
+	for _, whichq := range CFG.Crninja.Streams {
+		got = append(got, fmt.Sprintf("%v %v %v %v", whichq.Name, whichq.Table, whichq.FormatPage2, whichq.Page2.Page2Ltr))
+	}
+	want := []string{
+		"letters tletterqq false ",
+		"letters2 tletterqq2 false ",
+		"dds dd_notify true 77",
+		"dds2 dd_notify2 true 78",
+		"stream1 tarrears false ",
+		"renewals trenewals false ",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("streams are\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if CFG.Crninja.Crletters.Table != "" || CFG.Crninja.Crdouble.Table != "" || CFG.Crninja.Letters != nil || CFG.Crninja.Doubles != nil {
+		t.Errorf("original streams still configured: %+v", CFG.Crninja)
+	}
+
+}
+
+// fakeTools stands in for pdftk, writing a token PDF wherever it would
+// write its output and recording each command
+type fakeTools struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (f *fakeTools) Run(name string, args ...string) ([]byte, error) {
+
+	f.mu.Lock()
+	f.commands = append(f.commands, name+" "+strings.Join(args, " "))
+	f.mu.Unlock()
+	for i, arg := range args {
+		switch {
+		case arg == "output" && i+1 < len(args):
+			if err := os.WriteFile(args[i+1], []byte("%PDF-1.4 "+name+"\n"), 0644); err != nil {
+				return nil, err
+			}
+		case arg == "dump_data":
+			return []byte("NumberOfPages: 2\n"), nil
+		}
+	}
+	return nil, nil
+
+}
+
+// useSecureFolder sets up securing the documents in a temporary folder,
+// looking up customers, PlanNo => values by planDataColumns
+func useSecureFolder(t *testing.T, customers map[string]map[string]any) (*stubDB, *fakeTools, string) {
+
+	t.Helper()
+	saveCFG, saveRunner, saveCtx, saveStats, saveBody := CFG, runner, runCtx, stats, bodyTemplate
+	t.Cleanup(func() {
+		CFG, runner, runCtx, stats, bodyTemplate = saveCFG, saveRunner, saveCtx, saveStats, saveBody
+		storedAs = make(map[string]string)
+	})
+
+	folder := t.TempDir()
+	CFG.Pdftk.Exec = "pdftk"
+	CFG.Pdftk.Tool = TOOL_PDFTK
+	CFG.Pdftk.Folder = folder
+	CFG.Pdftk.PDFPrefix = "ltr-"
+	CFG.Pdftk.PDFPrefix2 = "tm2-"
+	CFG.Pdftk.PDFPrefix3 = "sec-"
+	CFG.Pdftk.PDFMask = `^ltr-.*\.pdf$`
+	CFG.Pdftk.PasswordField = DEFAULT_PASSWORDFIELD
+	CFG.Email.Delivery = DELIVERY_QUEUE
+	CFG.Email.Subject = "Your documents"
+	CFG.Email.Bodytext = "Dear #DearSir#"
+	var err error
+	if bodyTemplate, err = planTemplate("Email.Bodytext", CFG.Email.Bodytext); err != nil {
+		t.Fatal(err)
+	}
+
+	tools := &fakeTools{}
+	runner = tools
+	runCtx = context.Background()
+	stats = runStats{Failures: map[string]int{}}
+	storedAs = make(map[string]string)
+	db := &stubDB{answer: func(xsql string, args []any) stubResult {
+		if !strings.Contains(xsql, "FROM tcustomers WHERE PlanNo=?") {
+			return stubResult{}
+		}
+		customer, ok := customers[fmt.Sprint(args[len(args)-1])]
+		if !ok {
+			return stubResult{}
+		}
+		var row []any
+		for _, col := range planDataColumns {
+			row = append(row, customer[col])
+		}
+		return stubResult{cols: planDataColumns, rows: [][]any{row}}
+	}}
+	useStubDB(t, db)
+	return db, tools, folder
+
+}
+
+// queuedEmails is what was inserted into toutgoingemails
+func queuedEmails(db *stubDB) []string {
+
+	var res []string
+	for _, xsql := range db.execs {
+		if strings.HasPrefix(xsql, "INSERT INTO toutgoingemails") {
+			res = append(res, xsql)
+		}
+	}
+	return res
+
+}
+
+func TestMakeSecurePDFsResumes(t *testing.T) {
+
+	db, tools, folder := useSecureFolder(t, map[string]map[string]any{
+		"1001": {PD_PRODUCT: "Gold", PD_EMAIL: "ann@example.com", PD_LASTNAME: "Smith", PD_STATUS: "Live", PD_PLANNO: "1001"},
+	})
+	// As left by a run that stopped after securing, plus one that can't be
+	original := filepath.Join(folder, "ltr-1001-5.pdf")
+	secured := filepath.Join(folder, "sec-1001-5.pdf")
+	for _, f := range []string{original, secured, filepath.Join(folder, "ltr-1002-5.pdf")} {
+		if err := os.WriteFile(f, []byte("%PDF-1.4\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := makeSecurePDFs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tools.commands) != 0 {
+		t.Errorf("secured again with %v", tools.commands)
+	}
+	if _, err := os.Stat(original); !os.IsNotExist(err) {
+		t.Errorf("original not removed, %v", err)
+	}
+	if emails := queuedEmails(db); len(emails) != 1 || !strings.Contains(emails[0], "sec-1001-5.pdf") {
+		t.Errorf("queued %v, want the secured copy emailed", emails)
+	}
+	if stats.Secured != 1 {
+		t.Errorf("secured %v, want 1", stats.Secured)
+	}
+
+}
+
+func TestMakeSecurePDFsMaxFiles(t *testing.T) {
+
+	_, tools, folder := useSecureFolder(t, nil)
+	CFG.Pdftk.MaxFiles = 1
+	for _, f := range []string{"ltr-1001-5.pdf", "ltr-1002-5.pdf"} {
+		if err := os.WriteFile(filepath.Join(folder, f), []byte("%PDF-1.4\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := makeSecurePDFs(); !errors.Is(err, errTooManyFiles) {
+		t.Errorf("returned %v, want %v", err, errTooManyFiles)
+	}
+	if len(tools.commands) != 0 || stats.Secured != 0 {
+		t.Errorf("secured %v with %v", stats.Secured, tools.commands)
+	}
+
+}
+
+func TestEmailSecurePDFQueuesBcc(t *testing.T) {
+
+	db, _, folder := useSecureFolder(t, nil)
+	CFG.Email.Bcc = "copies@example.com"
+	CFG.Email.BadEmailDefault = "o'brien@example.com"
+	plandata := map[string]string{PD_PLANNO: "1001", PD_LASTNAME: "Smith"}
+
+	if err := emailSecurePDF(filepath.Join(folder, "sec-1001-5.pdf"), nil, plandata, 0); err != nil {
+		t.Fatal(err)
+	}
+	emails := queuedEmails(db)
+	if len(emails) != 1 {
+		t.Fatalf("queued %v, want one email", emails)
+	}
+	for _, want := range []string{"ToAddress,BCAddress,Subject", `'o\'brien@example.com','copies@example.com','Your documents'`} {
+		if !strings.Contains(emails[0], want) {
+			t.Errorf("queued %v, want %v", emails[0], want)
+		}
+	}
+
+}
+
+// runFunc is a Runner answering every command itself
+type runFunc func(name string, args ...string) ([]byte, error)
+
+func (f runFunc) Run(name string, args ...string) ([]byte, error) { return f(name, args...) }
+
+func TestPdfPageCount(t *testing.T) {
+
+	save, saveRunner := CFG, runner
+	t.Cleanup(func() { CFG, runner = save, saveRunner })
+	CFG.Pdftk.Exec = "pdftk"
+	pdf := filepath.Join(t.TempDir(), "ltr-1001-5.pdf")
+	if err := os.WriteFile(pdf, []byte("%PDF-1.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		tool, out string
+		want      int
+	}{
+		{TOOL_PDFTK, "InfoBegin\nNumberOfPages: 3\nPageMediaBegin\n", 3},
+		{TOOL_QPDF, "12\n", 12},
+		{TOOL_PDFTK, "InfoBegin\n", -1},
+		{TOOL_QPDF, "WARNING: damaged\n", -1},
+	} {
+		CFG.Pdftk.Tool = tc.tool
+		runner = runFunc(func(name string, args ...string) ([]byte, error) { return []byte(tc.out), nil })
+		got, err := pdfPageCount(pdf, "")
+		if tc.want < 0 {
+			if err == nil {
+				t.Errorf("%v %q counted %v pages, want an error", tc.tool, tc.out, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%v %q counted %v pages, %v, want %v", tc.tool, tc.out, got, err, tc.want)
+		}
+	}
+
+}
+
+func TestMakeSecurePDFsGroupedPageCount(t *testing.T) {
+
+	ann := map[string]any{PD_PRODUCT: "Gold", PD_EMAIL: "ann@example.com", PD_PHONE: "01234 567890", PD_LASTNAME: "Smith", PD_STATUS: "Live"}
+	db, tools, folder := useSecureFolder(t, map[string]map[string]any{"1001": ann, "1002": ann})
+	CFG.Email.GroupByAddress = true
+	CFG.Email.IncludePageCount = true
+	CFG.Email.Bodytext = "#PageCount# pages"
+	var err error
+	if bodyTemplate, err = planTemplate("Email.Bodytext", CFG.Email.Bodytext); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"ltr-1001-5.pdf", "ltr-1002-7.pdf"} {
+		if err := os.WriteFile(filepath.Join(folder, f), []byte("%PDF-1.4\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := makeSecurePDFs(); err != nil {
+		t.Fatal(err)
+	}
+	if emails := queuedEmails(db); len(emails) != 1 || !strings.Contains(emails[0], "'4 pages'") {
+		t.Errorf("queued %v, want one email for 4 pages", emails)
+	}
+	for _, cmd := range tools.commands {
+		if strings.Contains(cmd, "dump_data") && (strings.Contains(cmd, "input_pw") || !strings.Contains(cmd, "ltr-")) {
+			t.Errorf("pages counted with %v, want the unsecured original", cmd)
+		}
+	}
+
+}
+
+func TestMakeSecurePDFsRandomPassword(t *testing.T) {
+
+	db, tools, folder := useSecureFolder(t, map[string]map[string]any{
+		"1001": {PD_PRODUCT: "Gold", PD_EMAIL: "ann@example.com", PD_PHONE: "123", PD_LASTNAME: "Smith", PD_STATUS: "Live", PD_PLANNO: "1001"},
+	})
+	CFG.Pdftk.MinPasswordLength = 8
+	CFG.Pdftk.ShortPasswordAction = SHORTPW_RANDOM
+	CFG.Pdftk.RandomPasswordColumn = "cPdfPassword"
+	if err := os.WriteFile(filepath.Join(folder, "ltr-1001-5.pdf"), []byte("%PDF-1.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := makeSecurePDFs(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(db.execs, "UPDATE tcustomers SET cPdfPassword=? WHERE PlanNo=?") {
+		t.Fatalf("random password not saved, ran %v", db.execs)
+	}
+	var userpw []string
+	for _, cmd := range tools.commands {
+		if _, pw, ok := strings.Cut(cmd, " user_pw "); ok {
+			userpw = append(userpw, strings.Fields(pw)[0])
+		}
+	}
+	if len(userpw) != 1 || len(userpw[0]) != 8 || userpw[0] == "123" {
+		t.Errorf("secured with %v, want a random 8 character password", userpw)
+	}
+	if len(queuedEmails(db)) != 1 {
+		t.Errorf("queued %v, want one email", queuedEmails(db))
+	}
+
+}
+
+func TestFormatCurrency(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+
+	for _, tc := range []struct {
+		symbol string
+		amount float64
+		want   string
+	}{
+		{"", 0, "£0.00"},
+		{"", 12.5, "£12.50"},
+		{"", -12.5, "-£12.50"},
+		{"", -0.001, "£0.00"},
+		{"", 999.999, "£1,000.00"},
+		{"", 1234567.891, "£1,234,567.89"},
+		{"", -1234.5, "-£1,234.50"},
+		{"€", 100000, "€100,000.00"},
+	} {
+		CFG.Email.CurrencySymbol = tc.symbol
+		if got := formatCurrency(tc.amount); got != tc.want {
+			t.Errorf("formatCurrency(%v) with %q is %v, want %v", tc.amount, tc.symbol, got, tc.want)
+		}
+	}
+
+}
+
+// claimDB answers claimBatch's queries, with locked from the lock, max
+// the highest batch so far, next the sequence's NextBatch (none if 0) and
+// last from LastSQL
+func claimDB(locked int64, max int64, next int64, last int64) *stubDB {
+
+	return &stubDB{answer: func(xsql string, args []any) stubResult {
+		switch {
+		case strings.Contains(xsql, "GET_LOCK"):
+			return stubResult{rows: [][]any{{locked}}}
+		case strings.HasPrefix(xsql, "SELECT MAX(PrintBatch)"):
+			return stubResult{rows: [][]any{{max}}}
+		case strings.HasPrefix(xsql, "SELECT NextBatch") && next > 0:
+			return stubResult{rows: [][]any{{next}}}
+		case strings.HasPrefix(xsql, "SELECT (@B := @B + 1)"):
+			return stubResult{rows: [][]any{{last}}}
+		}
+		return stubResult{}
+	}}
+
+}
+
+func TestClaimBatch(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	CFG.MySQL.Driver = DRIVER_MYSQL
+	whichq := STREAM{Name: "letters", Table: "tletterqq"}
+
+	for _, tc := range []struct {
+		method      string
+		next        int64
+		batch, last int64
+		want        []string
+	}{
+		{BATCH_SESSION, 0, 4, 7, []string{"SET @B := 4;"}},
+		{BATCH_SEQUENCE, 10, 9, 12, []string{"SET @B := 9;", "UPDATE tbatchsequence SET NextBatch=12 WHERE SeqName='tletterqq'"}},
+		{BATCH_SEQUENCE, 0, 4, 7, []string{"INSERT INTO tbatchsequence (SeqName,NextBatch) VALUES('tletterqq',5)", "SET @B := 4;", "UPDATE tbatchsequence SET NextBatch=7 WHERE SeqName='tletterqq'"}},
+	} {
+		CFG.Crninja.BatchMethod = tc.method
+		db := claimDB(1, 4, tc.next, tc.last)
+		useStubDB(t, db)
+		batch, last, err := claimBatch(whichq, DEFAULT_MAXSQL, DEFAULT_CLAIMSQL, DEFAULT_LASTSQL)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.method, err)
+		}
+		if batch != tc.batch || last != tc.last {
+			t.Errorf("%v next %v claimed %v to %v, want %v to %v", tc.method, tc.next, batch, last, tc.batch, tc.last)
+		}
+		for _, want := range tc.want {
+			if !slices.Contains(db.execs, want) {
+				t.Errorf("%v next %v ran %v, want %v", tc.method, tc.next, db.execs, want)
+			}
+		}
+		if !db.committed || db.rolledBack {
+			t.Errorf("%v next %v committed %v, rolled back %v", tc.method, tc.next, db.committed, db.rolledBack)
+		}
+	}
+
+}
+
+func TestClaimBatchNotLocked(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	CFG.MySQL.Driver = DRIVER_MYSQL
+	db := claimDB(0, 4, 0, 7)
+	useStubDB(t, db)
+
+	if _, _, err := claimBatch(STREAM{Table: "tletterqq"}, DEFAULT_MAXSQL, DEFAULT_CLAIMSQL, DEFAULT_LASTSQL); err == nil {
+		t.Error("claimed without the lock")
+	}
+	if len(db.execs) != 0 || db.committed || !db.rolledBack {
+		t.Errorf("ran %v, committed %v, rolled back %v", db.execs, db.committed, db.rolledBack)
+	}
+
+}
+
+func TestClaimBatchRollsBack(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	CFG.MySQL.Driver = DRIVER_MYSQL
+	CFG.Crninja.BatchMethod = BATCH_SEQUENCE
+	db := claimDB(1, 4, 10, 12)
+	db.failing = "UPDATE tletterqq"
+	useStubDB(t, db)
+
+	if _, _, err := claimBatch(STREAM{Table: "tletterqq"}, DEFAULT_MAXSQL, DEFAULT_CLAIMSQL, DEFAULT_LASTSQL); err == nil {
+		t.Error("claimed although the UPDATE failed")
+	}
+	if db.committed || !db.rolledBack {
+		t.Errorf("committed %v, rolled back %v, want the claim rolled back", db.committed, db.rolledBack)
+	}
+	for _, xsql := range db.execs {
+		if strings.HasPrefix(xsql, "UPDATE tbatchsequence") {
+			t.Errorf("sequence moved on with %v", xsql)
+		}
+	}
+
+}
+
+func TestRebind(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+
+	xsql := `UPDATE t SET a=?, b='why?', c="it's?" WHERE d=? AND e='o''brien?' AND f=?`
+	CFG.MySQL.Driver = DRIVER_MYSQL
+	if got := rebind(xsql); got != xsql {
+		t.Errorf("MySQL rebound to %v", got)
+	}
+	CFG.MySQL.Driver = DRIVER_POSTGRES
+	want := `UPDATE t SET a=$1, b='why?', c="it's?" WHERE d=$2 AND e='o''brien?' AND f=$3`
+	if got := rebind(xsql); got != want {
+		t.Errorf("rebound to\n%v\nwant\n%v", got, want)
+	}
+
+}
+
+func TestClaimBatchPostgres(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	CFG.MySQL.Driver = DRIVER_POSTGRES
+	lock := "SELECT 1 FROM pg_advisory_xact_lock(hashtext('pdfwrap:tletterqq'))"
+	db := &stubDB{answer: func(xsql string, args []any) stubResult {
+		switch {
+		case xsql == lock:
+			return stubResult{rows: [][]any{{int64(1)}}}
+		case strings.HasPrefix(xsql, "SELECT MAX(PrintBatch)"):
+			return stubResult{rows: [][]any{{int64(4)}}}
+		case strings.HasPrefix(xsql, "SELECT COALESCE(MAX(PrintBatch),0)+1 FROM tletterqq"):
+			return stubResult{rows: [][]any{{int64(7)}}}
+		}
+		return stubResult{}
+	}}
+	useStubDB(t, db)
+
+	batch, last, err := claimBatch(STREAM{Table: "tletterqq"}, DEFAULT_MAXSQL, POSTGRES_CLAIMSQL, POSTGRES_LASTSQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch != 4 || last != 7 {
+		t.Errorf("claimed %v to %v, want 4 to 7", batch, last)
+	}
+	if len(db.queries) == 0 || db.queries[0] != lock {
+		t.Errorf("queries %v, want the advisory lock first", db.queries)
+	}
+	// Released with the transaction rather than separately
+	if len(db.execs) != 1 || !strings.HasPrefix(db.execs[0], "UPDATE tletterqq SET PrintBatch=4+n.rn") {
+		t.Errorf("ran %v, want just the claim", db.execs)
+	}
+	if !db.committed {
+		t.Error("claim not committed")
+	}
+
+}
+
+func TestAuditTimeScan(t *testing.T) {
+
+	want := "2024-03-01 09:30:15"
+	for _, src := range []any{
+		time.Date(2024, 3, 1, 9, 30, 15, 0, time.UTC),
+		[]byte(want),
+		want,
+		"2024-03-01 09:30:15.000000",
+	} {
+		var got auditTime
+		if err := got.Scan(src); err != nil || got.Format(time.DateTime) != want {
+			t.Errorf("%T %v scanned as %v, %v, want %v", src, src, got.Format(time.DateTime), err, want)
+		}
+	}
+	var bad auditTime
+	if err := bad.Scan(int64(0)); err == nil {
+		t.Error("scanned a number as a time")
+	}
+
+}
+
+func TestAuditChain(t *testing.T) {
+
+	save, saveKey, saveSeq, savePrev, saveRun, saveLog := CFG, auditKey, auditSeq, auditPrev, runID, slog.Default()
+	t.Cleanup(func() {
+		CFG, auditKey, auditSeq, auditPrev, runID = save, saveKey, saveSeq, savePrev, saveRun
+		slog.SetDefault(saveLog)
+	})
+	CFG.MySQL.Driver = DRIVER_MYSQL
+	CFG.MySQL.AuditTable = "taudit"
+	auditKey, auditSeq, auditPrev, runID = []byte("secret"), 0, "", "20240301093015-42"
+	db := &stubDB{}
+	useStubDB(t, db)
+
+	for i, planno := range []string{"1001", "1002", "1003"} {
+		if err := audit("email", planno, fmt.Sprintf("sec-%v-%v.pdf", planno, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// As read back from the table
+	rvalues := regexp.MustCompile(`VALUES\('([^']*)',(\d+),'([^']*)','([^']*)',(\d+),'([^']*)','([0-9a-f]+)'\)$`)
+	var rows [][]any
+	for _, xsql := range db.execs {
+		m := rvalues.FindStringSubmatch(xsql)
+		if m == nil {
+			t.Fatalf("can't read back %v", xsql)
+		}
+		seq, _ := strconv.ParseInt(m[2], 10, 64)
+		rows = append(rows, []any{m[1], seq, m[3], m[4], m[5], m[6], m[7]})
+	}
+	var logged strings.Builder
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+	useStubDB(t, &stubDB{answer: func(xsql string, args []any) stubResult {
+		return stubResult{rows: rows}
+	}})
+
+	if !verifyAudit(runID) {
+		t.Fatalf("untouched records failed verification\n%v", logged.String())
+	}
+	rows[1][5] = "sec-9999-1.pdf"
+	logged.Reset()
+	if verifyAudit(runID) {
+		t.Fatal("altered record verified")
+	}
+	if !strings.Contains(logged.String(), `msg="Audit record altered" run=20240301093015-42 seq=2 `) || strings.Count(logged.String(), "Audit record altered") != 1 {
+		t.Errorf("want just record 2 reported as altered, logged\n%v", logged.String())
+	}
+
+}
+
+func TestCompileMaskGlob(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	CFG.Pdftk.MaskMode = "glob"
+
+	for _, tc := range []struct {
+		mask, name  string
+		insensitive bool
+		want        bool
+	}{
+		{"ltr-*.pdf", "ltr-1001-5.pdf", false, true},
+		{"ltr-*.pdf", "ltrX1001-5.pdf", false, false},
+		{"ltr-*.pdf", "ltr-1001-5xpdf", false, false},
+		{"ltr-*.pdf", "xltr-1001-5.pdf", false, false},
+		{"ltr-*.pdf", "ltr-1001-5.pdf.bak", false, false},
+		{"ltr-?.pdf", "ltr-1.pdf", false, true},
+		{"ltr-?.pdf", "ltr-12.pdf", false, false},
+		{"ltr-[0-9]*.pdf", "ltr-1001.pdf", false, true},
+		{"ltr-[0-9]*.pdf", "ltr-a.pdf", false, false},
+		{"ltr-*.pdf", "LTR-1001.PDF", false, false},
+		{"ltr-*.pdf", "LTR-1001.PDF", true, true},
+	} {
+		CFG.Pdftk.MaskCaseInsensitive = tc.insensitive
+		re, err := compileMask(tc.mask)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := re.MatchString(tc.name); got != tc.want {
+			t.Errorf("%v (insensitive %v) matches %v: %v, want %v", tc.mask, tc.insensitive, tc.name, got, tc.want)
+		}
+	}
+
+}
+
+func TestQpdfArgs(t *testing.T) {
+
+	for _, tc := range []struct {
+		args string
+		want string
+	}{
+		{"a.pdf b.pdf cat output o.pdf", "--empty --pages a.pdf 1-z b.pdf 1-z -- o.pdf"},
+		{"A=a.pdf B=b.pdf cat A1 B2-end A2-end output o.pdf", "--empty --pages a.pdf 1 b.pdf 2-z a.pdf 2-z -- o.pdf"},
+		{"a.pdf cat 1 output o.pdf", "--empty --pages a.pdf 1 -- o.pdf"},
+		{"in.pdf background bg.pdf output o.pdf", "in.pdf --underlay bg.pdf --from= --repeat=1 -- o.pdf"},
+		{"in.pdf stamp st.pdf output o.pdf", "in.pdf --overlay st.pdf --from= --repeat=1 -- o.pdf"},
+		{"in.pdf multistamp st.pdf output o.pdf", "in.pdf --overlay st.pdf -- o.pdf"},
+		{"in.pdf input_pw secret dump_data", "--password=secret --show-npages in.pdf"},
+	} {
+		res, err := qpdfArgs(strings.Fields(tc.args))
+		if err != nil {
+			t.Errorf("%v: %v", tc.args, err)
+			continue
+		}
+		if got := strings.Join(res, " "); got != tc.want {
+			t.Errorf("%v is qpdf %v, want %v", tc.args, got, tc.want)
+		}
+	}
+	for _, args := range []string{"a.pdf b.pdf output o.pdf", "A=a.pdf cat B1 output o.pdf", "in.pdf burst output o.pdf"} {
+		if res, err := qpdfArgs(strings.Fields(args)); err == nil {
+			t.Errorf("%v is qpdf %v, want an error", args, strings.Join(res, " "))
+		}
+	}
+
+}
+
+func TestSetConfig(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+
+	if err := setConfig("pdftk.s3.bucket", "letters"); err != nil || CFG.Pdftk.S3.Bucket != "letters" {
+		t.Errorf("set Pdftk.S3.Bucket to %q, %v", CFG.Pdftk.S3.Bucket, err)
+	}
+	if err := setConfig("Email.Terms.Gold", "gold.pdf"); err != nil || CFG.Email.Terms["Gold"] != "gold.pdf" {
+		t.Errorf("set Email.Terms.Gold to %q, %v", CFG.Email.Terms["Gold"], err)
+	}
+	for key, want := range map[string]string{
+		"Email.Terms":          "is a section",
+		"Email.Terms.Gold.Pdf": "is a map of simple values",
+		"Email.Nonesuch":       "no setting Email.Nonesuch",
+		"Pdftk.Folder.Name":    "Pdftk.Folder has no setting Name",
+	} {
+		if err := setConfig(key, "x"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("setting %v gave %v, want an error mentioning %q", key, err, want)
+		}
+	}
+
+}
+
+func TestNormaliseField(t *testing.T) {
+
+	for _, tc := range []struct {
+		val  string
+		ops  []string
+		want string
+	}{
+		{"  Mr  Smith ", []string{"trim"}, "Mr  Smith"},
+		{"  Mr  Smith ", []string{"collapse"}, "Mr Smith"},
+		{"mr smith", []string{"upper"}, "MR SMITH"},
+		{"MR SMITH", []string{"Lower"}, "mr smith"},
+		{" o'BRIEN  éLAN ", []string{"title"}, "O'brien Élan"},
+		{" mr   smith ", []string{"collapse", "upper"}, "MR SMITH"},
+		{" ", []string{"title"}, ""},
+		{" Smith", []string{"reverse"}, " Smith"},
+		{" Smith", nil, " Smith"},
+	} {
+		if got := normaliseField(tc.val, tc.ops); got != tc.want {
+			t.Errorf("normaliseField(%q, %v) is %q, want %q", tc.val, tc.ops, got, tc.want)
+		}
+	}
+
+}
+
+func TestGeneratePDFsWorkerPanic(t *testing.T) {
+
+	_, _, folder := useSecureFolder(t, nil)
+	CFG.MySQL.Driver = DRIVER_MYSQL
+	CFG.Crninja.Exec = "crninja"
+	CFG.Crninja.Workers = 2
+	db := &stubDB{answer: func(xsql string, args []any) stubResult {
+		switch {
+		case strings.Contains(xsql, "GET_LOCK"):
+			return stubResult{rows: [][]any{{int64(1)}}}
+		case strings.HasPrefix(xsql, "SELECT MAX(PrintBatch)"):
+			return stubResult{rows: [][]any{{int64(0)}}}
+		case strings.HasPrefix(xsql, "SELECT (@B := @B + 1)"):
+			return stubResult{rows: [][]any{{int64(2)}}}
+		case strings.Contains(xsql, "FROM tletterqq WHERE PrintBatch > 0"):
+			return stubResult{rows: [][]any{{"1001", "5", int64(1)}, {"1002", "7", int64(2)}}}
+		}
+		return stubResult{}
+	}}
+	useStubDB(t, db)
+	tools := &fakeTools{}
+	runner = runFunc(func(name string, args ...string) ([]byte, error) {
+		if strings.Contains(strings.Join(args, " "), "ltr-1002-7") {
+			panic("bad record")
+		}
+		for i, arg := range args {
+			if arg == "-O" && i+1 < len(args) {
+				return nil, os.WriteFile(args[i+1], []byte("%PDF-1.4\n"), 0644)
+			}
+		}
+		return tools.Run(name, args...)
+	})
+
+	err := generatePDFs(STREAM{Name: "letters", Rpt: "letter.rpt", Table: "tletterqq", PlanNo: "PlanNo", Ltrid: "LtrID"})
+	if err == nil || !strings.Contains(err.Error(), "plan 1002 letter 7 panicked: bad record") {
+		t.Errorf("returned %v, want the panic", err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "ltr-1001-5.pdf")); err != nil || stats.Generated != 1 {
+		t.Errorf("generated %v, %v, want the other plan's letter", stats.Generated, err)
+	}
+
+}
+
+func TestMakeSecurePDFsSandboxInfoFile(t *testing.T) {
+
+	_, tools, folder := useSecureFolder(t, map[string]map[string]any{
+		"1001": {PD_PRODUCT: "Gold", PD_EMAIL: "ann@example.com", PD_PHONE: "01234 567890", PD_LASTNAME: "Smith", PD_STATUS: "Live", PD_PLANNO: "1001"},
+	})
+	saveSandboxed, saveFolder := sandboxed, sandboxFolder
+	t.Cleanup(func() { sandboxed, sandboxFolder = saveSandboxed, saveFolder })
+	sandboxed, sandboxFolder = true, t.TempDir()
+	CFG.Pdftk.Infofile = "info.txt"
+	if err := os.WriteFile(filepath.Join(sandboxFolder, "ltr-1001-5.pdf"), []byte("%PDF-1.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := makeSecurePDFs(); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(folder)
+	if len(entries) != 0 {
+		t.Errorf("wrote %v outside the sandbox", entries)
+	}
+	info := filepath.Join(sandboxFolder, "info.txt")
+	if !strings.Contains(strings.Join(tools.commands, "\n"), "update_info "+info) {
+		t.Errorf("commands %v, want the info file from the sandbox", tools.commands)
+	}
+
+}
+
+func TestMakeSecurePDFsGroupedAudit(t *testing.T) {
+
+	ann := func(planno string) map[string]any {
+		return map[string]any{PD_PRODUCT: "Gold", PD_EMAIL: "ann@example.com", PD_PHONE: "01234 567890", PD_LASTNAME: "Smith", PD_STATUS: "Live", PD_PLANNO: planno}
+	}
+	db, _, folder := useSecureFolder(t, map[string]map[string]any{"1001": ann("1001"), "1002": ann("1002")})
+	CFG.Email.GroupByAddress = true
+	CFG.MySQL.AuditTable = "taudit"
+	for _, f := range []string{"ltr-1001-5.pdf", "ltr-1001-6.pdf", "ltr-1002-7.pdf"} {
+		if err := os.WriteFile(filepath.Join(folder, f), []byte("%PDF-1.4\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := makeSecurePDFs(); err != nil {
+		t.Fatal(err)
+	}
+	if emails := queuedEmails(db); len(emails) != 1 {
+		t.Errorf("queued %v, want one email", emails)
+	}
+	var audits []string
+	for _, xsql := range db.execs {
+		if strings.HasPrefix(xsql, "INSERT INTO taudit") {
+			audits = append(audits, xsql)
+		}
+	}
+	sec := func(name string) string { return filepath.Join(folder, name) }
+	want := []string{
+		",'email',1001,'" + sec("sec-1001-5.pdf") + ATTACHMENT_SEPARATOR + sec("sec-1001-6.pdf") + "')",
+		",'email',1002,'" + sec("sec-1002-7.pdf") + "')",
+	}
+	if len(audits) != len(want) {
+		t.Fatalf("audited %v, want an entry for each plan", audits)
+	}
+	for i := range want {
+		if !strings.HasSuffix(audits[i], want[i]) {
+			t.Errorf("audited %v, want it to end %v", audits[i], want[i])
+		}
+	}
+
+}
+
+func TestMakeSecurePDFsSkipStatus(t *testing.T) {
+
+	db, tools, folder := useSecureFolder(t, map[string]map[string]any{
+		"1001": {PD_PRODUCT: "Gold", PD_EMAIL: "ann@example.com", PD_LASTNAME: "Smith", PD_STATUS: "Lapsed", PD_PLANNO: "1001"},
+	})
+	CFG.Email.StatusActions = map[string]string{"Lapsed": STATUS_SKIP}
+	CFG.Pdftk.Recursive = true
+	if err := os.WriteFile(filepath.Join(folder, "ltr-1001-5.pdf"), []byte("%PDF-1.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 1; run <= 2; run++ {
+		if err := makeSecurePDFs(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(folder, SKIPPED_FOLDER, "ltr-1001-5.pdf")); err != nil {
+		t.Errorf("not moved to %v, %v", SKIPPED_FOLDER, err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "ltr-1001-5.pdf")); !os.IsNotExist(err) {
+		t.Errorf("still in the folder, %v", err)
+	}
+	if len(tools.commands) != 0 || stats.Secured != 0 {
+		t.Errorf("secured %v with %v", stats.Secured, tools.commands)
+	}
+	if len(db.queries) != 1 {
+		t.Errorf("queries %v, want the plan looked up by the first run only", db.queries)
+	}
+
+}
+
+func TestPrefetchFieldsMatchesPerPlan(t *testing.T) {
+
+	save := CFG
+	t.Cleanup(func() { CFG = save })
+	CFG.MySQL.Driver = DRIVER_MYSQL
+	CFG.Email.DateFormat = "dd/mm/yyyy"
+	defs := map[string]fieldDef{
+		"DueDate": {"DueDate FROM tcustomers", FIELD_VALUE_TYPE_DATE},
+		"Premium": {"Premium FROM tcustomers", FIELD_VALUE_TYPE_CURRENCY},
+		"Term":    {"Term FROM tcustomers", FIELD_VALUE_TYPE_INTEGER},
+		"Agent":   {"Agent FROM tcustomers", FIELD_VALUE_TYPE_TEXT},
+	}
+	// Everything NULL for plan 1001, set for 1002
+	values := map[string]map[string]any{
+		"1001": {},
+		"1002": {"DueDate": "2024-03-01", "Premium": "1234.5", "Term": "10", "Agent": "Smith"},
+	}
+	answer := func(xsql string, args []any) stubResult {
+		if strings.Contains(xsql, "FROM tstdletterfields") {
+			var res stubResult
+			for id, def := range defs {
+				res.rows = append(res.rows, []any{id, def.SQL, def.Type})
+			}
+			return res
+		}
+		for id, def := range defs {
+			if strings.HasPrefix(xsql, "SELECT PlanNo,"+def.SQL+" ") {
+				return stubResult{rows: [][]any{{"1001", values["1001"][id]}, {"1002", values["1002"][id]}}}
+			}
+			if strings.HasPrefix(xsql, "SELECT "+def.SQL+" ") {
+				return stubResult{rows: [][]any{{values[fmt.Sprint(args[0])][id]}}}
+			}
+		}
+		return stubResult{}
+	}
+	txt := "[[DueDate]] [[Premium]] [[Term]] [[Agent]]"
+
+	for _, planno := range []string{"1001", "1002"} {
+		useStubDB(t, &stubDB{answer: answer})
+		want, err := replaceFields(txt, planno)
+		if err != nil {
+			t.Fatal(err)
+		}
+		useStubDB(t, &stubDB{answer: answer})
+		prefetchFields(txt, []string{"1001", "1002"})
+		if len(fieldCache) != len(defs) {
+			t.Fatalf("prefetched %v, want every field", fieldCache)
+		}
+		got, err := replaceFields(txt, planno)
+		if err != nil || got != want {
+			t.Errorf("plan %v prefetched is %q, %v, want %q as fetched per plan", planno, got, err, want)
+		}
+	}
+
+}
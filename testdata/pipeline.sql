@@ -0,0 +1,60 @@
+-- Fixture for the integration test: enough of the production schema for
+-- one letter stream, its customers and the email queue. Loading it
+-- replaces any tables of the same names.
+
+DROP TABLE IF EXISTS tliterals, tletterqq, tcustomers, toutgoingemails, tstdletterfields;
+
+CREATE TABLE tliterals (
+	Name varchar(40) NOT NULL PRIMARY KEY,
+	Value varchar(255)
+);
+
+CREATE TABLE tletterqq (
+	ID int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	PlanNo int NOT NULL,
+	LtrID int NOT NULL,
+	PrintBatch int NOT NULL DEFAULT 0,
+	DelMeth int NOT NULL DEFAULT 1,
+	PrintedWhen datetime NULL
+);
+
+CREATE TABLE tcustomers (
+	PlanNo int NOT NULL PRIMARY KEY,
+	Product varchar(20),
+	cEmail varchar(100),
+	cPhone varchar(20),
+	cPostcode varchar(10),
+	cTitle varchar(10),
+	cFirstname varchar(40),
+	cLastname varchar(40),
+	CustomerPassword varchar(40),
+	RecordStatus varchar(20)
+);
+
+CREATE TABLE toutgoingemails (
+	ID int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	SentAt datetime,
+	SentBy varchar(40),
+	PlanNo int,
+	ToAddress varchar(255),
+	BCAddress varchar(255),
+	Subject varchar(255),
+	MsgText text,
+	Attachments text
+);
+
+CREATE TABLE tstdletterfields (
+	FieldID varchar(40) NOT NULL PRIMARY KEY,
+	FieldSQL text,
+	FieldValueType int
+);
+
+INSERT INTO tliterals (Name, Value) VALUES ('Company', 'Saphena');
+
+-- Two letters to email and one for the post, which isn't claimed
+INSERT INTO tletterqq (PlanNo, LtrID, DelMeth) VALUES (1001, 5, 1), (1002, 7, 1), (1003, 5, 2);
+
+INSERT INTO tcustomers (PlanNo, Product, cEmail, cPhone, cPostcode, cTitle, cFirstname, cLastname, CustomerPassword, RecordStatus) VALUES
+	(1001, 'Gold', 'ann@example.com', '01234 567890', 'AB1 2CD', 'Mrs', 'Ann', 'Smith', '', 'Live'),
+	(1002, 'Gold', 'bob@example.com', '07700 900123', 'EF3 4GH', '', 'Bob', 'Jones', '', 'Live'),
+	(1003, 'Gold', '', '01632 960000', 'IJ5 6KL', 'Mr', 'Carl', 'Brown', '', 'Live');